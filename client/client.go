@@ -1,15 +1,17 @@
 package client
 
 import (
+	"crypto/cipher"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 const (
@@ -23,19 +25,39 @@ const (
 	LoginErr = -3
 	// SplitErr 拆分错误
 	SplitErr = -4
+	// ConflictErr 服务端已存在同名文件，拒绝上传
+	ConflictErr = -5
+	// PathErr 文件名不合法，服务端拒绝上传
+	PathErr = -6
+	// DirErr 目录中有文件上传失败
+	DirErr = -7
+	// SpaceErr 服务端存储空间不足，拒绝上传
+	SpaceErr = -8
 )
 
-type client struct {
-	conn    net.Conn       // 连接
-	usr     string         // 用户名
-	pw      string         // 密码
-	uid     string         // 唯一id
-	fn      string         // 文件名
-	tsize   int64          // 文件总大小
-	ssize   int64          // 单个拆分文件大小
-	usize   int64          // 已上传大小
-	prochan chan int       //上传文件进度channel
-	wg      sync.WaitGroup // 记录拆分文件上传协程
+// uploadRetry 未完成的拆分文件连续多少轮没有减少时放弃上传
+const uploadRetry = 5
+
+// upload 一次文件上传
+type upload struct {
+	c        *Client        // 客户端配置
+	conn     net.Conn       // 连接
+	uid      string         // 上传会话id
+	session  string         // 续传的上传会话id，为空时服务端创建新的会话
+	key      string         // 记录未完成的上传会话的key，见sessions
+	fn       string         // 本地文件名
+	remote   string         // 服务端文件名
+	tsize    int64          // 文件总大小
+	ssize    int64          // 单个拆分文件大小
+	usize    int64          // 已上传大小
+	compress string         // 协商的拆分文件压缩算法
+	meta     *cipherMeta    // 端到端加密元数据，不加密时为nil
+	holes    []extent       // 发送给服务端的文件空洞
+	holeIdx  map[int]bool   // 全部在空洞中的拆分文件序号，服务端接受空洞时不上传
+	changed  bool           // 续传时服务端记录的源文件指纹与本地文件不一致
+	aead     cipher.AEAD    // 端到端加密算法
+	prochan  chan int       //上传文件进度channel
+	wg       sync.WaitGroup // 记录拆分文件上传协程
 }
 
 func init() {
@@ -43,89 +65,169 @@ func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-// ServerConn 服务端连接信息
+// ServerConn 服务端连接信息，包级别的上传、下载和管理函数使用
 var ServerConn = "127.0.0.1:10000"
 
-// connServer 连接服务端
-func connServer() (net.Conn, error) {
-	errTime := 0
-	for errTime < 10 {
-		conn, err := net.DialTimeout("tcp", ServerConn, time.Second*3)
-		if err != nil {
-			log.Printf("连接服务器失败, %s\n", err)
-			errTime++
-			time.Sleep(time.Second * 1)
-			continue
-		}
-		log.Printf("连接成功, remote:%s, local:%s\n", conn.RemoteAddr().String(), conn.LocalAddr().String())
-		return conn, nil
-	}
-	return nil, fmt.Errorf("连接超时")
+// Upload 使用包变量的配置上传文件，见Client.Upload
+func Upload(fn string, prochan chan int) bool {
+	return defaultClient().Upload(fn, prochan)
 }
 
-// Upload 上传文件
-func Upload(fn string, prochan chan int) bool {
+// UploadTo 使用包变量的配置上传文件到服务端的dst，见Client.UploadTo
+func UploadTo(fn, dst string, prochan chan int) bool {
+	return defaultClient().UploadTo(fn, dst, prochan)
+}
+
+// ResumeUpload 使用包变量的配置续传文件，见Client.ResumeUpload
+func ResumeUpload(id, fn, dst string, prochan chan int) bool {
+	return defaultClient().ResumeUpload(id, fn, dst, prochan)
+}
+
+// Upload 上传文件，服务端文件名使用本地文件名（不包含目录）
+func (c *Client) Upload(fn string, prochan chan int) bool {
+	return c.UploadTo(fn, "", prochan)
+}
+
+// UploadTo 上传文件到服务端的dst
+// dst为空时使用本地文件名，以/结尾时表示服务端目录，文件保存在目录下并使用本地文件名
+// 之前上传同一个文件失败时续传之前的上传会话
+func (c *Client) UploadTo(fn, dst string, prochan chan int) bool {
+	return c.ResumeUpload(c.Session(fn, dst), fn, dst, prochan)
+}
+
+// ResumeUpload 使用上传会话id续传文件到服务端的dst
+// 会话不存在或者已过期时服务端创建新的会话，重新上传
+func (c *Client) ResumeUpload(id, fn, dst string, prochan chan int) bool {
 	// 获取文件大小
-	size, err := getFileSize(fn)
-	if err != nil || 0 == size {
+	size, err := c.getFileSize(fn)
+	if err != nil {
 		prochan <- FileInfoErr
 		return false
 	}
-	conn, err := connServer()
+	conn, err := c.connServer()
 	if err != nil {
 		prochan <- ServerConErr
 		return false
 	}
-	defer conn.Close()
-	cli := &client{
+	cli := &upload{
+		c:       c,
 		conn:    conn,
-		usr:     defaultUser,
-		pw:      defaultPw,
 		fn:      fn,
+		session: id,
+		remote:  remoteName(fn, dst),
 		tsize:   size,
 		prochan: prochan,
 	}
-	ok, err := login(cli.conn, cli.usr, cli.pw)
+	if cli.key, err = c.sessionKey(fn, cli.remote); err != nil {
+		prochan <- FileInfoErr
+		return false
+	}
+	// 主连接断开后会重新连接
+	defer func() { cli.conn.Close() }()
+	ok, err := c.login(cli.conn)
 	if err != nil || !ok {
-		log.Printf("登陆失败, fn:%s\n", fn)
+		c.logf("登陆失败, fn:%s\n", fn)
 		prochan <- LoginErr
 		return false
 	}
 	if err = cli.splitScheme(); err != nil {
+		switch err {
+		case errIdentical:
+			prochan <- 100
+			return true
+		case ErrExists:
+			prochan <- ConflictErr
+		case ErrBadPath:
+			prochan <- PathErr
+		case errNoSpace:
+			prochan <- SpaceErr
+		default:
+			prochan <- SplitErr
+		}
+		return false
+	}
+	sessions.Store(cli.key, cli.uid)
+	// 源文件变化后校验已上传的拆分文件，清空不一致的拆分文件
+	if err = cli.checkSource(); err != nil {
 		prochan <- SplitErr
 		return false
 	}
-	fnum := cli.fileNum()
+	// 每一轮先查询服务端已接收的数据，只上传没有完成的拆分文件
+	// 连续uploadRetry轮未完成的拆分文件没有减少时放弃上传，会话保留用于续传
+	last, stall := -1, 0
 	for {
-		cli.wg.Add(fnum)
-		for i := 0; i < fnum; i++ {
-			go cli.uploadSplitFile(i)
+		pending := cli.pending()
+		if last >= 0 && len(pending) >= last {
+			stall++
+		} else {
+			stall = 0
 		}
-		cli.wg.Wait()
+		if stall >= uploadRetry {
+			c.logf("上传没有进展，放弃上传, uid:%s, 未完成的拆分文件:%d\n", cli.uid, len(pending))
+			prochan <- ServerConErr
+			return false
+		}
+		last = len(pending)
+		cli.uploadChunks(pending)
 		if cli.endUpload() {
 			break
 		}
 	}
+	sessions.Delete(cli.key)
+	// 空文件没有拆分文件，上传进度不会更新
+	if cli.tsize == 0 {
+		prochan <- 100
+	}
 	return true
 }
 
-// getFileSize 获取文件大小
-func getFileSize(fn string) (int64, error) {
+// uploadChunks 上传拆分文件，UploadWorkers大于0时限制同时上传的个数
+func (cli *upload) uploadChunks(pending []int) {
+	n := cli.c.UploadWorkers
+	if n <= 0 {
+		n = len(pending)
+	}
+	sem := make(chan struct{}, n)
+	cli.wg.Add(len(pending))
+	for _, i := range pending {
+		sem <- struct{}{}
+		go func(idx int) {
+			defer func() { <-sem }()
+			cli.uploadSplitFile(idx)
+		}(i)
+	}
+	cli.wg.Wait()
+}
+
+// remoteName 返回服务端文件名
+func remoteName(fn, dst string) string {
+	base := filepath.Base(fn)
+	if dst == "" {
+		return base
+	}
+	if strings.HasSuffix(dst, "/") {
+		return dst + base
+	}
+	return dst
+}
+
+// getFileSize 获取文件大小，空文件的大小为0，文件不存在或者不是普通文件时返回错误
+func (c *Client) getFileSize(fn string) (int64, error) {
 	fInfo, err := os.Stat(fn)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Printf("%s大小为0\n", fn)
-			return 0, nil
-		}
-		log.Printf("获取%s大小错误, %s\n", fn, err)
+		c.logf("获取%s大小错误, %s\n", fn, err)
 		return 0, err
 	}
-	log.Printf("%s大小为：%d\n", fn, fInfo.Size())
+	if !fInfo.Mode().IsRegular() {
+		c.logf("%s不是普通文件\n", fn)
+		return 0, fmt.Errorf("not a regular file: %s", fn)
+	}
+	c.logf("%s大小为：%d\n", fn, fInfo.Size())
 	return fInfo.Size(), nil
 }
 
 // fileNum 获取拆分文件的个数
-func (cli *client) fileNum() int {
+func (cli *upload) fileNum() int {
 	fnum := cli.tsize / cli.ssize
 	if cli.tsize%cli.ssize != 0 {
 		return int(fnum) + 1
@@ -133,108 +235,189 @@ func (cli *client) fileNum() int {
 	return int(fnum)
 }
 
+// chunkSize 返回第idx个拆分文件的大小
+func (cli *upload) chunkSize(idx int) int64 {
+	end := int64(idx+1) * cli.ssize
+	if end > cli.tsize {
+		end = cli.tsize
+	}
+	return end - int64(idx)*cli.ssize
+}
+
 // uploadSplitFile 上传分拆文件
-func (cli *client) uploadSplitFile(idx int) {
+func (cli *upload) uploadSplitFile(idx int) {
 	defer cli.wg.Done()
+	if cli.holeIdx[idx] {
+		cli.refProgress(cli.chunkSize(idx))
+		return
+	}
 	fp, err := os.OpenFile(cli.fn, os.O_RDONLY, 0755)
 	if err != nil {
-		log.Printf("打开文件失败, idx:%d, err:%s\n", idx, err)
+		cli.c.logf("打开文件失败, idx:%d, err:%s\n", idx, err)
 		return
 	}
 	defer fp.Close()
 	// 拆分文件上传新建连接
-	conn, err := connServer()
+	conn, err := cli.c.connServer()
 	if err != nil {
 		return
 	}
 	defer conn.Close()
-	ok, err := login(conn, cli.usr, cli.pw)
+	ok, err := cli.c.login(conn)
 	if err != nil || !ok {
-		log.Printf("登陆失败, idx:%d, err:%s\n", idx, err)
+		cli.c.logf("登陆失败, idx:%d, err:%s\n", idx, err)
 		return
 	}
-	ctn, err := ctnLoc(conn, cli.uid, idx)
+	ctn, err := cli.ctnLoc(conn, idx)
 	if err != nil {
 		return
 	}
-	offset := int64(idx)*cli.ssize + ctn
-	log.Printf("文件移动位置:%d, uid:%s, idx:%d\n", offset, cli.uid, idx)
-	if _, err = fp.Seek(offset, 0); err != nil {
-		log.Printf("移动文件指针失败,uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+	// 按照协商的算法压缩拆分文件数据
+	zw, err := compressWriter(cli.compress, conn)
+	if err != nil {
+		cli.c.logf("创建压缩流失败, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
 		return
 	}
-	// todo 从服务端获取续传位置
+	if cli.aead != nil {
+		err = cli.writeSealed(zw, fp, idx, ctn)
+	} else {
+		err = cli.writePlain(zw, fp, idx, ctn)
+	}
+	if err != nil {
+		return
+	}
+	// 写入压缩结束标识
+	if err = zw.Close(); err != nil {
+		cli.c.logf("结束压缩流错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+	}
+}
+
+// writePlain 从续传位置开始发送拆分文件
+func (cli *upload) writePlain(w io.Writer, fp *os.File, idx int, ctn int64) error {
+	offset := int64(idx)*cli.ssize + ctn
+	cli.c.logf("文件移动位置:%d, uid:%s, idx:%d\n", offset, cli.uid, idx)
+	if _, err := fp.Seek(offset, 0); err != nil {
+		cli.c.logf("移动文件指针失败,uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+		return err
+	}
 	buf := make([]byte, 1024)
 	var n int
+	var err error
 	var totalSize = ctn
 	for totalSize < cli.ssize {
 		if n, err = fp.Read(buf); err != nil {
 			if err == io.EOF {
-				log.Printf("读取结束EOF, uid:%s, idx:%d\n", cli.uid, idx)
+				cli.c.logf("读取结束EOF, uid:%s, idx:%d\n", cli.uid, idx)
 				break
 			}
-			log.Printf("文件读取错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
-			return
+			cli.c.logf("文件读取错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+			return err
 		}
 		totalSize += int64(n)
 		// 文件读取超过了分拆文件的大小
 		if totalSize > cli.ssize {
 			n -= int(totalSize - cli.ssize)
 		}
-		if err = writeBufferTimeOut(conn, buf[:n]); err != nil {
-			log.Printf("写文件到net buffer错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
-			return
+		if _, err = w.Write(buf[:n]); err != nil {
+			cli.c.logf("写文件到net buffer错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+			return err
 		}
 		cli.refProgress(int64(n))
 	}
+	return nil
 }
 
 // ctnLoc 从服务端获取续传位置
-func ctnLoc(conn net.Conn, uid string, idx int) (int64, error) {
+func (cli *upload) ctnLoc(conn net.Conn, idx int) (int64, error) {
+	uid := cli.uid
 	split := fmt.Sprintf("split %s %d", uid, idx)
-	if err := writeBufferTimeOut(conn, []byte(split)); err != nil {
-		log.Printf("传送分拆文件信息到服务端错误, uid:%s, idx:%d, err:%s\n", uid, idx, err)
+	if err := cli.c.writeBufferTimeOut(conn, []byte(split)); err != nil {
+		cli.c.logf("传送分拆文件信息到服务端错误, uid:%s, idx:%d, err:%s\n", uid, idx, err)
 		return 0, err
 	}
-	locB, n, err := readBufferTimeOut(conn)
+	locB, n, err := cli.c.readBufferTimeOut(conn)
 	if err != nil {
-		log.Printf("获取文件续传位置失败, uid:%s, idx:%d, err:%s\n", uid, idx, err)
+		cli.c.logf("获取文件续传位置失败, uid:%s, idx:%d, err:%s\n", uid, idx, err)
 		return 0, err
 	}
 	locStr := string(locB[:n])
 	if locStr == "server exception" {
-		log.Printf("获取文件续传位置失败,服务端异常, uid:%s, idx:%d, err:%s\n", uid, idx, err)
+		cli.c.logf("获取文件续传位置失败,服务端异常, uid:%s, idx:%d, err:%s\n", uid, idx, err)
 		return 0, fmt.Errorf("服务端异常")
 	}
 	loc, err := strconv.ParseInt(locStr, 10, 64)
 	if err != nil {
-		log.Printf("获取文件续传位置失败, uid:%s, idx:%d, loc:%s, err:%s\n", uid, idx, locStr, err)
+		cli.c.logf("获取文件续传位置失败, uid:%s, idx:%d, loc:%s, err:%s\n", uid, idx, locStr, err)
 		return 0, err
 	}
 	return loc, nil
 }
 
 // refProgress 更新上传文件大小，刷新进度
-func (cli *client) refProgress(n int64) {
+func (cli *upload) refProgress(n int64) {
 	size := atomic.AddInt64(&cli.usize, n)
 	percent := (size * 100) / cli.tsize
 	cli.prochan <- int(percent)
 }
 
 // endUpload 客户端结束上传
-func (cli *client) endUpload() bool {
+// 主连接断开时（例如服务端重启）重新连接，下一次在新的连接上结束上传，服务端根据会话记录恢复会话
+// 协议：end {unique_id} 0
+// 返回：success [name={file.name}]，提交时重新选择了文件名时返回name，其他结果表示失败
+func (cli *upload) endUpload() bool {
 	// 客户端主连接向服务端发送当前id结束信号
 	endStr := fmt.Sprintf("end %s %d", cli.uid, 0)
-	if err := writeBufferTimeOut(cli.conn, []byte(endStr)); err != nil {
-		log.Printf("发送结束信号到服务端失败, uid:%s, err:%s\n", cli.uid, err)
+	if err := cli.c.writeBufferTimeOut(cli.conn, []byte(endStr)); err != nil {
+		cli.c.logf("发送结束信号到服务端失败, uid:%s, err:%s\n", cli.uid, err)
+		cli.reconnect()
 		return false
 	}
-	resB, n, err := readBufferTimeOut(cli.conn)
+	resB, n, err := cli.c.readBufferTimeOut(cli.conn)
 	if err != nil {
-		log.Printf("获取结束结果失败, uid:%s, err:%s\n", cli.uid, err)
+		cli.c.logf("获取结束结果失败, uid:%s, err:%s\n", cli.uid, err)
+		cli.reconnect()
 		return false
 	}
 	res := string(resB[:n])
-	log.Printf("发送结束信号，服务端返回结果:%s\n", res)
-	return res == "success"
+	cli.c.logf("发送结束信号，服务端返回结果:%s\n", res)
+	arr := strings.Fields(res)
+	if len(arr) == 0 || arr[0] != "success" {
+		return false
+	}
+	// 组装期间其他会话生成了同名文件，服务端提交时重新选择了文件名
+	if opts, err := analyzeOpts(arr[1:]); err == nil && opts["name"] != "" {
+		cli.c.logf("提交时服务端已存在同名文件，重命名为:%s, remote:%s\n", opts["name"], cli.remote)
+	}
+	return true
+}
+
+// reconnect 重新建立主连接，并在新的连接上恢复上传会话，之后的status和end由会话的主连接处理
+// 会话已经不存在时服务端创建新的会话，重新上传
+func (cli *upload) reconnect() {
+	conn, err := cli.c.connLogin()
+	if err != nil {
+		cli.c.logf("重新连接服务端失败, uid:%s, err:%s\n", cli.uid, err)
+		return
+	}
+	cli.conn.Close()
+	cli.conn = conn
+	cli.session, cli.changed = cli.uid, false
+	if err = cli.splitScheme(); err != nil {
+		cli.c.logf("恢复上传会话失败, uid:%s, err:%s\n", cli.uid, err)
+		return
+	}
+	sessions.Store(cli.key, cli.uid)
+	cli.checkSource()
+}
+
+// checkSource 服务端返回源文件变化时校验已上传的拆分文件
+func (cli *upload) checkSource() error {
+	if !cli.changed {
+		return nil
+	}
+	err := cli.verifySource()
+	if err != nil {
+		cli.c.logf("校验已上传的拆分文件失败, uid:%s, err:%s\n", cli.uid, err)
+	}
+	return err
 }
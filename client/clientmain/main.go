@@ -2,8 +2,11 @@ package main
 
 import (
 	"log"
+	"path"
+	"path/filepath"
 	"songxh/file_transport/client"
 	"strconv"
+	"strings"
 
 	"github.com/andlabs/ui"
 )
@@ -14,9 +17,23 @@ func main() {
 		serverlabel := ui.NewLabel("服务端地址:")
 		serverinput := ui.NewEntry()
 		serverinput.SetText("127.0.0.1:10000")
+		userlabel := ui.NewLabel("用户名:")
+		userinput := ui.NewEntry()
+		userinput.SetText("client")
+		pwlabel := ui.NewLabel("密码:")
+		pwinput := ui.NewPasswordEntry()
 		input := ui.NewEntry()
 		input.SetReadOnly(true)
+		// 服务端保存的目录和文件名，文件名默认为本地文件名
+		dirlabel := ui.NewLabel("服务端目录:")
+		dirinput := ui.NewEntry()
+		namelabel := ui.NewLabel("服务端文件名:")
+		nameinput := ui.NewEntry()
 		open := ui.NewButton("打开文件")
+		// 选择目录中的任意文件，上传文件所在的目录
+		openDir := ui.NewButton("打开目录")
+		// 是否上传目录
+		isDir := false
 		upload := ui.NewButton("上传")
 		// 默认未选择文件时无法上传
 		upload.Disable()
@@ -24,15 +41,26 @@ func main() {
 		box1 := ui.NewHorizontalBox()
 		box2 := ui.NewHorizontalBox()
 		box3 := ui.NewHorizontalBox()
+		box4 := ui.NewHorizontalBox()
 		box1.Append(serverlabel, false)
 		box1.Append(serverinput, true)
+		box1.Append(userlabel, false)
+		box1.Append(userinput, true)
+		box1.Append(pwlabel, false)
+		box1.Append(pwinput, true)
 		box2.Append(input, true)
+		box4.Append(dirlabel, false)
+		box4.Append(dirinput, true)
+		box4.Append(namelabel, false)
+		box4.Append(nameinput, true)
 		box3.Append(open, true)
+		box3.Append(openDir, true)
 		box3.Append(upload, true)
 		//------垂直排列的容器---------
 		div := ui.NewVerticalBox()
 		div.Append(box1, true)
 		div.Append(box2, true)
+		div.Append(box4, true)
 		div.Append(box3, true)
 
 		window.SetChild(div)
@@ -48,19 +76,34 @@ func main() {
 				return
 			}
 			input.SetText(fn)
+			nameinput.SetText(filepath.Base(fn))
+			isDir = false
+			upload.Enable()
+		})
+		// 打开目录按钮点击功能
+		openDir.OnClicked(func(*ui.Button) {
+			fn := ui.OpenFile(window)
+			if fn == "" {
+				return
+			}
+			dir := filepath.Dir(fn)
+			input.SetText(dir)
+			nameinput.SetText(filepath.Base(dir))
+			isDir = true
 			upload.Enable()
 		})
 		// 开始上传文件
 		upload.OnClicked(func(*ui.Button) {
 			upload.Disable()
 			defer upload.Enable()
-			if input.Text() == "" {
+			if input.Text() == "" || nameinput.Text() == "" {
 				return
 			}
+			dst := path.Join(dirinput.Text(), nameinput.Text())
 			prochan := make(chan int)
 			// 进度条
 			progressbar := ui.NewProgressBar()
-			fnLabel := ui.NewLabel(input.Text() + ":")
+			fnLabel := ui.NewLabel(dst + ":")
 			statLabel := ui.NewLabel("上传中")
 			box := ui.NewHorizontalBox()
 			box.Append(fnLabel, true)
@@ -68,8 +111,13 @@ func main() {
 			box.Append(statLabel, true)
 			div.Append(box, true)
 			go uploadProgress(prochan, progressbar, statLabel)
-			client.ServerConn = serverinput.Text()
-			go client.Upload(input.Text(), prochan)
+			// 每次上传使用界面上当前的服务端地址和用户
+			c := client.NewClient(serverinput.Text(), userinput.Text(), pwinput.Text())
+			if isDir {
+				go uploadDir(window, c, input.Text(), dst, prochan)
+				return
+			}
+			go c.UploadTo(input.Text(), dst, prochan)
 		})
 		window.Show()
 	})
@@ -78,6 +126,27 @@ func main() {
 	}
 }
 
+// uploadDir 上传目录，结束后显示上传失败的文件
+func uploadDir(window *ui.Window, c *client.Client, dir, dst string, prochan chan int) {
+	results, err := c.UploadDir(dir, dst, prochan)
+	if err != nil {
+		log.Printf("上传目录失败, dir:%s, err:%s\n", dir, err)
+		return
+	}
+	var failed []string
+	for _, res := range results {
+		if res.Code != 100 {
+			failed = append(failed, res.Remote+": "+strconv.Itoa(res.Code))
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	ui.QueueMain(func() {
+		ui.MsgBoxError(window, "上传失败的文件", strings.Join(failed, "\n"))
+	})
+}
+
 // uploadProgress 更新上传进度
 func uploadProgress(prochan chan int, progressbar *ui.ProgressBar, statLabel *ui.Label) {
 	defer close(prochan)
@@ -102,6 +171,22 @@ func uploadProgress(prochan chan int, progressbar *ui.ProgressBar, statLabel *ui
 				statLabel.SetText("拆分方案错误")
 				statLabel.Show()
 				break
+			case client.ConflictErr:
+				statLabel.SetText("服务端已存在同名文件")
+				statLabel.Show()
+				break
+			case client.PathErr:
+				statLabel.SetText("文件名不合法")
+				statLabel.Show()
+				break
+			case client.DirErr:
+				statLabel.SetText("部分文件上传失败")
+				statLabel.Show()
+				break
+			case client.SpaceErr:
+				statLabel.SetText("服务端存储空间不足")
+				statLabel.Show()
+				break
 			}
 			break
 		}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// noCompress 不压缩
+const noCompress = "none"
+
+// Compressor 根据数据流创建压缩流，关闭压缩流时需要写入结束标识但不能关闭底层数据流
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// Compression 客户端按优先级向服务端提供的压缩算法，为空时不压缩
+var Compression = []string{"deflate", "gzip"}
+
+var (
+	compMu sync.RWMutex
+	// 支持的压缩算法, key=算法名称
+	compressors = map[string]Compressor{
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestSpeed)
+		},
+		"deflate": func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.BestSpeed)
+		},
+	}
+)
+
+// 已经压缩过的文件类型，压缩这些文件只会浪费cpu
+var compressedExt = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".mp3": true, ".mp4": true, ".mkv": true, ".avi": true, ".mov": true,
+}
+
+// sampleSize 判断文件是否可压缩时读取的样本大小
+const sampleSize = 64 * 1024
+
+// RegisterCompressor 注册压缩算法，同名算法会被覆盖
+// 注册后需要加入Compression才会向服务端提供
+func RegisterCompressor(name string, c Compressor) {
+	compMu.Lock()
+	defer compMu.Unlock()
+	compressors[name] = c
+}
+
+// getCompressor 获取压缩算法
+func getCompressor(name string) (Compressor, bool) {
+	compMu.RLock()
+	defer compMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+// compressOffer 返回向服务端提供的压缩算法列表，逗号分隔
+// 文件内容不可压缩时返回空
+func (c *Client) compressOffer(fn string) string {
+	if !c.compressible(fn) {
+		return ""
+	}
+	var offer []string
+	for _, name := range c.Compression {
+		if _, ok := getCompressor(name); ok {
+			offer = append(offer, name)
+		}
+	}
+	return strings.Join(offer, ",")
+}
+
+// compressible 判断文件是否值得压缩
+// 先根据扩展名排除已压缩的文件，再压缩文件开头的样本，压缩率不足10%时认为不可压缩
+func (c *Client) compressible(fn string) bool {
+	if compressedExt[strings.ToLower(filepath.Ext(fn))] {
+		return false
+	}
+	fp, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	sample, err := io.ReadAll(io.LimitReader(fp, sampleSize))
+	if err != nil || len(sample) == 0 {
+		return false
+	}
+	var out bytes.Buffer
+	zw, _ := flate.NewWriter(&out, flate.BestSpeed)
+	zw.Write(sample)
+	zw.Close()
+	ok := out.Len() < len(sample)*9/10
+	c.logf("文件压缩检测, fn:%s, sample:%d, compressed:%d, compressible:%t\n", fn, len(sample), out.Len(), ok)
+	return ok
+}
+
+// compressWriter 返回拆分文件数据的写入流，不压缩时直接写入连接
+func compressWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	if name == "" || name == noCompress {
+		return nopWriteCloser{w}, nil
+	}
+	c, ok := getCompressor(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown compress %s", name)
+	}
+	return c(w)
+}
+
+// nopWriteCloser 关闭时不做任何操作的写入流
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close 不关闭底层数据流
+func (nopWriteCloser) Close() error {
+	return nil
+}
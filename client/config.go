@@ -0,0 +1,147 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// defaultWorkers 默认同时下载的拆分块数和同时上传的目录文件数
+	defaultWorkers = 4
+	// defaultDialTimeout 默认的连接超时时间
+	defaultDialTimeout = time.Second * 3
+	// defaultDialRetry 默认的连接重试次数
+	defaultDialRetry = 10
+)
+
+// Client 客户端，保存服务端地址、用户和传输参数
+// 创建后不再修改字段时可以被多个协程同时使用，不同的Client可以连接不同的服务端
+// 拆分文件的大小由服务端决定，客户端通过压缩算法和并发数调整拆分文件的传输
+type Client struct {
+	Addr            string        // 服务端地址
+	User            string        // 用户名
+	Password        string        // 密码
+	UploadWorkers   int           // 上传一个文件时同时上传的拆分文件数，小于等于0时不限制
+	DownloadWorkers int           // 下载一个文件时同时下载的拆分块数，小于等于0时为1
+	DirWorkers      int           // 上传目录时同时上传的文件数，小于等于0时为1
+	Compression     []string      // 按优先级向服务端提供的压缩算法，为空时不压缩
+	Conflict        string        // 服务端已存在同名文件时的处理策略，见Conflict
+	Passphrase      string        // 端到端加密口令，为空时不加密
+	PreserveXattrs  bool          // 是否上传源文件的扩展属性
+	DialTimeout     time.Duration // 连接服务端的超时时间
+	DialRetry       int           // 连接服务端失败时的最大尝试次数，小于等于0时为1
+	Timeout         time.Duration // 连接上每次读写的超时时间，为0时不超时
+	Logger          *log.Logger   // 日志输出，为nil时使用log包的默认日志
+}
+
+// NewClient 创建使用默认传输参数的客户端
+func NewClient(addr, user, pw string) *Client {
+	return &Client{
+		Addr:            addr,
+		User:            user,
+		Password:        pw,
+		DownloadWorkers: defaultWorkers,
+		DirWorkers:      defaultWorkers,
+		Compression:     []string{"deflate", "gzip"},
+		DialTimeout:     defaultDialTimeout,
+		DialRetry:       defaultDialRetry,
+	}
+}
+
+// defaultClient 返回使用包变量配置的客户端，包级别的函数通过它执行
+// 每次调用时读取包变量的当前值
+func defaultClient() *Client {
+	return &Client{
+		Addr:            ServerConn,
+		User:            defaultUser,
+		Password:        defaultPw,
+		DownloadWorkers: DownloadWorkers,
+		DirWorkers:      DirWorkers,
+		Compression:     Compression,
+		Conflict:        Conflict,
+		Passphrase:      Passphrase,
+		PreserveXattrs:  PreserveXattrs,
+		DialTimeout:     defaultDialTimeout,
+		DialRetry:       defaultDialRetry,
+	}
+}
+
+// logf 输出日志，文件名和行号为调用logf的位置
+func (c *Client) logf(format string, v ...any) {
+	l := c.Logger
+	if l == nil {
+		l = log.Default()
+	}
+	l.Output(2, fmt.Sprintf(format, v...))
+}
+
+// workers 返回并发数，小于等于0时为1
+func workers(n int) int {
+	if n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// connServer 连接服务端
+func (c *Client) connServer() (net.Conn, error) {
+	retry := c.DialRetry
+	if retry <= 0 {
+		retry = 1
+	}
+	for errTime := 0; errTime < retry; errTime++ {
+		if errTime > 0 {
+			time.Sleep(time.Second * 1)
+		}
+		conn, err := net.DialTimeout("tcp", c.Addr, c.DialTimeout)
+		if err != nil {
+			c.logf("连接服务器失败, %s\n", err)
+			continue
+		}
+		c.logf("连接成功, remote:%s, local:%s\n", conn.RemoteAddr().String(), conn.LocalAddr().String())
+		if c.Timeout > 0 {
+			return &timeoutConn{Conn: conn, timeout: c.Timeout}, nil
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("连接超时")
+}
+
+// connLogin 连接服务端并登陆
+func (c *Client) connLogin() (net.Conn, error) {
+	conn, err := c.connServer()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := c.login(conn)
+	if err != nil || !ok {
+		conn.Close()
+		c.logf("登陆失败, err:%v\n", err)
+		return nil, fmt.Errorf("登陆失败")
+	}
+	return conn, nil
+}
+
+// timeoutConn 每次读写前设置超时时间的连接
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read 设置读超时后读取
+func (tc *timeoutConn) Read(p []byte) (int, error) {
+	if err := tc.Conn.SetReadDeadline(time.Now().Add(tc.timeout)); err != nil {
+		return 0, err
+	}
+	return tc.Conn.Read(p)
+}
+
+// Write 设置写超时后写入
+func (tc *timeoutConn) Write(p []byte) (int, error) {
+	if err := tc.Conn.SetWriteDeadline(time.Now().Add(tc.timeout)); err != nil {
+		return 0, err
+	}
+	return tc.Conn.Write(p)
+}
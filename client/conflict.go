@@ -0,0 +1,36 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Conflict 服务端已存在同名文件时的处理策略，为空时使用服务端的默认策略
+// overwrite：覆盖，rename：保留两个文件，新文件自动重命名，skip：内容相同时跳过上传，否则覆盖，reject：拒绝上传
+var Conflict = ""
+
+var (
+	// ErrExists 服务端已存在同名文件，拒绝上传
+	ErrExists = fmt.Errorf("file exists")
+	// errIdentical 服务端已存在内容相同的文件，跳过上传
+	errIdentical = fmt.Errorf("file identical")
+	// errNoSpace 服务端存储空间不足，拒绝上传
+	errNoSpace = fmt.Errorf("insufficient storage")
+)
+
+// fileSum 计算文件的sha256
+func fileSum(fn string) (string, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
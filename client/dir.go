@@ -0,0 +1,197 @@
+package client
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DirWorkers 上传目录时同时上传的文件数
+var DirWorkers = 4
+
+// FileResult 上传目录时单个文件的上传结果
+type FileResult struct {
+	Path   string // 本地文件名
+	Remote string // 服务端文件名
+	Size   int64  // 文件大小
+	Code   int    // 上传结果：100为成功，小于0为错误码
+}
+
+// dirProgress 上传目录的总进度，所有文件共享
+type dirProgress struct {
+	mu      sync.Mutex
+	total   int64    // 所有文件的总大小
+	done    int64    // 已上传的大小
+	percent int      // 上次发送的进度
+	prochan chan int // 上传进度channel
+}
+
+// add 增加已上传的大小，进度变化时发送，全部结束前最多为99
+func (dp *dirProgress) add(n int64) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.done += n
+	percent := 99
+	if dp.total > 0 && dp.done < dp.total {
+		percent = int(dp.done * 100 / dp.total)
+	}
+	if percent > 99 {
+		percent = 99
+	}
+	if percent != dp.percent {
+		dp.percent = percent
+		dp.prochan <- percent
+	}
+}
+
+// UploadDir 使用包变量的配置上传本地目录，见Client.UploadDir
+func UploadDir(dir, dst string, prochan chan int) ([]FileResult, error) {
+	return defaultClient().UploadDir(dir, dst, prochan)
+}
+
+// UploadDir 上传本地目录到服务端的dst，包括空目录，多个文件同时上传
+// dst为空时使用本地目录名，以/结尾时表示服务端上级目录，目录保存在上级目录下并使用本地目录名
+// 本地目录名取绝对路径的最后一级，dir为.或者..时使用实际的目录名
+// prochan接收所有文件的总进度，全部成功时为100，否则为DirErr；返回每个文件的上传结果
+func (c *Client) UploadDir(dir, dst string, prochan chan int) ([]FileResult, error) {
+	dir = filepath.Clean(dir)
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		c.logf("获取目录绝对路径错误, dir:%s, err:%s\n", dir, err)
+		prochan <- FileInfoErr
+		return nil, err
+	}
+	root := strings.TrimSuffix(remoteName(abs, dst), "/")
+	var dirs []string
+	var results []FileResult
+	err = filepath.WalkDir(dir, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(root, filepath.ToSlash(rel))
+		if d.IsDir() {
+			dirs = append(dirs, remote)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			c.logf("跳过非普通文件, fn:%s\n", fn)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		results = append(results, FileResult{Path: fn, Remote: remote, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		c.logf("遍历目录错误, dir:%s, err:%s\n", dir, err)
+		prochan <- FileInfoErr
+		return nil, err
+	}
+	// 先创建目录，空目录也保留
+	for _, remote := range dirs {
+		if err = c.Mkdir(remote); err != nil {
+			c.logf("创建服务端目录错误, dir:%s, err:%s\n", remote, err)
+			prochan <- DirErr
+			return nil, err
+		}
+	}
+	dp := &dirProgress{prochan: prochan}
+	for _, res := range results {
+		dp.total += res.Size
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers(c.DirWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx].Code = c.uploadDirFile(&results[idx], dp)
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, res := range results {
+		if res.Code != 100 {
+			c.logf("目录中的文件上传失败, fn:%s, code:%d\n", res.Path, res.Code)
+			prochan <- DirErr
+			return results, nil
+		}
+	}
+	prochan <- 100
+	return results, nil
+}
+
+// uploadDirFile 上传目录中的一个文件，按文件的进度更新目录的总进度，返回上传结果
+func (c *Client) uploadDirFile(res *FileResult, dp *dirProgress) int {
+	fileChan := make(chan int)
+	var ok bool
+	go func() {
+		ok = c.UploadTo(res.Path, res.Remote, fileChan)
+		close(fileChan)
+	}()
+	code, sent := SplitErr, int64(0)
+	for progress := range fileChan {
+		if progress < 0 {
+			code = progress
+			continue
+		}
+		if progress > 100 {
+			progress = 100
+		}
+		// 重新查询服务端状态后文件进度可能回退，总进度只增加
+		size := res.Size * int64(progress) / 100
+		if size > sent {
+			dp.add(size - sent)
+			sent = size
+		}
+	}
+	if !ok {
+		return code
+	}
+	// 续传时已上传的部分没有进度
+	dp.add(res.Size - sent)
+	return 100
+}
+
+// Mkdir 使用包变量的配置在服务端创建目录，见Client.Mkdir
+func Mkdir(dir string) error {
+	return defaultClient().Mkdir(dir)
+}
+
+// Mkdir 在服务端创建目录以及所有上级目录
+func (c *Client) Mkdir(dir string) error {
+	conn, err := c.connLogin()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("mkdir %s 0", dir))); err != nil {
+		return err
+	}
+	buf, n, err := c.readBufferTimeOut(conn)
+	if err != nil {
+		return err
+	}
+	switch res := strings.TrimSpace(string(buf[:n])); res {
+	case "success":
+		return nil
+	case "badpath":
+		return ErrBadPath
+	default:
+		return fmt.Errorf("创建目录失败: %s", res)
+	}
+}
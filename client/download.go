@@ -0,0 +1,411 @@
+package client
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DownloadWorkers 下载文件时同时下载的拆分块数
+var DownloadWorkers = 4
+
+// ErrNotFound 服务端文件不存在
+var ErrNotFound = fmt.Errorf("file not found")
+
+// ErrNeedPassphrase 服务端文件使用端到端加密，没有设置口令时不下载
+var ErrNeedPassphrase = fmt.Errorf("文件使用端到端加密，需要设置Passphrase")
+
+// downloadRetry 拆分块下载失败时重试的轮数
+const downloadRetry = 3
+
+// download 一次文件下载
+type download struct {
+	c        *Client     // 客户端配置
+	remote   string      // 服务端文件名
+	dst      string      // 本地文件名
+	dir      string      // 保存拆分块的临时目录：{dst所在目录}/.{dst文件名}.download
+	scheme   string      // 服务端回复的下载方案，与临时目录中保存的不一致时重新下载
+	size     int64       // 文件大小
+	chunk    int64       // 拆分块大小
+	mtime    time.Time   // 服务端文件的修改时间
+	sums     []string    // 每个拆分块的sha256
+	verified []bool      // 拆分块是否已经下载完成并校验通过
+	done     int64       // 已下载的大小
+	prochan  chan int    // 下载进度channel，为nil时不发送
+	meta     *cipherMeta // 端到端加密元数据，不加密时为nil
+	aead     cipher.AEAD // 端到端加密的文件组装时逐个解密拆分块，不加密时为nil
+	plain    int64       // 端到端加密的文件解密后的大小
+}
+
+// Download 使用包变量的配置下载服务端文件，见Client.Download
+func Download(fn, dst string, prochan chan int) error {
+	return defaultClient().Download(fn, dst, prochan)
+}
+
+// Download 下载服务端文件fn并保存到本地dst，多个拆分块通过不同的连接同时下载
+// dst为空时保存到当前目录并使用服务端文件名（不包含目录），以/结尾时表示本地目录
+// 下载中断后再次下载同一个文件时，已下载的拆分块保存在临时目录中，从中断的位置续传；服务端文件变化时重新下载
+// 所有拆分块校验sha256后组装到临时文件，落盘后重命名为dst；prochan接收下载进度，可以为nil
+// 端到端加密的文件使用c.Passphrase在组装时解密，没有设置口令时返回ErrNeedPassphrase
+// 文件不存在时返回ErrNotFound，文件名不合法时返回ErrBadPath
+func (c *Client) Download(fn, dst string, prochan chan int) error {
+	d := &download{c: c, remote: fn, dst: localName(fn, dst), prochan: prochan}
+	d.dir = filepath.Join(filepath.Dir(d.dst), "."+filepath.Base(d.dst)+".download")
+	if err := d.queryScheme(); err != nil {
+		return err
+	}
+	if err := d.prepareDir(); err != nil {
+		c.logf("创建下载临时目录失败, dir:%s, err:%s\n", d.dir, err)
+		return err
+	}
+	for round := 0; round < downloadRetry; round++ {
+		pending := d.pending()
+		if len(pending) == 0 {
+			break
+		}
+		c.logf("下载拆分块, fn:%s, 个数:%d, 第%d轮\n", fn, len(pending), round+1)
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, workers(c.DownloadWorkers))
+		for _, idx := range pending {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(idx int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				d.fetchPart(idx)
+			}(idx)
+		}
+		wg.Wait()
+	}
+	if pending := d.pending(); len(pending) > 0 {
+		c.logf("下载未完成, fn:%s, 未完成的拆分块:%v\n", fn, pending)
+		return fmt.Errorf("下载未完成, 未完成的拆分块个数: %d", len(pending))
+	}
+	if err := d.assemble(); err != nil {
+		c.logf("组装下载文件失败, fn:%s, dst:%s, err:%s\n", fn, d.dst, err)
+		return err
+	}
+	if prochan != nil {
+		prochan <- 100
+	}
+	return nil
+}
+
+// localName 返回下载文件的本地文件名
+func localName(fn, dst string) string {
+	base := path.Base(strings.Replace(fn, "\\", "/", -1))
+	if dst == "" {
+		return base
+	}
+	if strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, string(filepath.Separator)) {
+		return filepath.Join(dst, base)
+	}
+	return dst
+}
+
+// queryScheme 从服务端获取下载方案
+// 协议：get {file_name} 0
+// 返回：第一行为{file_size} {chunk_size} mtime={unix_nano} [enc={meta} plain={size}]，之后每个拆分块一行：{chunk_index} {sha256}，发送完成后关闭连接
+func (d *download) queryScheme() error {
+	conn, err := d.c.connLogin()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = d.c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("get %s 0", d.remote))); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	d.scheme = string(b)
+	lines := strings.Split(strings.TrimSuffix(d.scheme, "\n"), "\n")
+	switch lines[0] {
+	case "badpath":
+		return ErrBadPath
+	case "notfound":
+		d.c.logf("服务端文件不存在, fn:%s\n", d.remote)
+		return ErrNotFound
+	}
+	head := strings.Fields(lines[0])
+	if len(head) < 2 {
+		d.c.logf("下载协议错误, scheme:%s\n", lines[0])
+		return fmt.Errorf("protocol error")
+	}
+	if d.size, err = strconv.ParseInt(head[0], 10, 64); err != nil {
+		return err
+	}
+	if d.chunk, err = strconv.ParseInt(head[1], 10, 64); err != nil || d.chunk <= 0 {
+		return fmt.Errorf("protocol error")
+	}
+	opts, err := analyzeOpts(head[2:])
+	if err != nil {
+		return err
+	}
+	if ns, err := strconv.ParseInt(opts["mtime"], 10, 64); err == nil {
+		d.mtime = time.Unix(0, ns)
+	}
+	if opts["enc"] != "" {
+		if err = d.openCipher(opts["enc"], opts["plain"]); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines[1:] {
+		kv := strings.Fields(line)
+		if len(kv) != 2 || kv[0] != strconv.Itoa(len(d.sums)) {
+			d.c.logf("下载协议错误, line:%s\n", line)
+			return fmt.Errorf("protocol error")
+		}
+		d.sums = append(d.sums, kv[1])
+	}
+	if int64(len(d.sums)) != (d.size+d.chunk-1)/d.chunk {
+		d.c.logf("拆分块个数错误, size:%d, chunk:%d, num:%d\n", d.size, d.chunk, len(d.sums))
+		return fmt.Errorf("protocol error")
+	}
+	d.verified = make([]bool, len(d.sums))
+	return nil
+}
+
+// openCipher 根据服务端返回的端到端加密元数据和口令准备解密，口令错误时在下载前返回错误
+func (d *download) openCipher(enc, plain string) error {
+	if d.c.Passphrase == "" {
+		d.c.logf("服务端文件使用端到端加密, 没有设置口令, fn:%s\n", d.remote)
+		return ErrNeedPassphrase
+	}
+	meta, err := parseCipherMeta(enc)
+	if err != nil {
+		return err
+	}
+	if d.plain, err = strconv.ParseInt(plain, 10, 64); err != nil {
+		return fmt.Errorf("protocol error")
+	}
+	if d.aead, err = meta.aead(d.c.Passphrase); err != nil {
+		d.c.logf("端到端加密口令错误, fn:%s\n", d.remote)
+		return err
+	}
+	d.meta = meta
+	return nil
+}
+
+// prepareDir 创建保存拆分块的临时目录，服务端文件与之前下载时不同时清空
+func (d *download) prepareDir() error {
+	schemeFile := filepath.Join(d.dir, "scheme")
+	if b, err := os.ReadFile(schemeFile); err == nil && string(b) != d.scheme {
+		d.c.logf("服务端文件已变化，重新下载, fn:%s\n", d.remote)
+		if err = os.RemoveAll(d.dir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(schemeFile, []byte(d.scheme), 0644); err != nil {
+		return err
+	}
+	// 已下载的部分计入进度
+	for idx := range d.sums {
+		if info, err := os.Stat(d.partName(idx)); err == nil {
+			d.done += info.Size()
+		}
+	}
+	return nil
+}
+
+// partName 返回拆分块的临时文件名
+func (d *download) partName(idx int) string {
+	return filepath.Join(d.dir, strconv.Itoa(idx))
+}
+
+// chunkSize 返回第idx个拆分块的大小
+func (d *download) chunkSize(idx int) int64 {
+	if idx == len(d.sums)-1 {
+		return d.size - d.chunk*int64(idx)
+	}
+	return d.chunk
+}
+
+// pending 返回没有下载完成的拆分块，已下载完成的拆分块校验sha256，校验失败时删除后重新下载
+func (d *download) pending() []int {
+	var pending []int
+	for idx := range d.sums {
+		if d.verified[idx] {
+			continue
+		}
+		info, err := os.Stat(d.partName(idx))
+		if err != nil || info.Size() < d.chunkSize(idx) {
+			pending = append(pending, idx)
+			continue
+		}
+		if info.Size() == d.chunkSize(idx) && d.verify(idx) {
+			d.verified[idx] = true
+			continue
+		}
+		d.c.logf("拆分块校验失败，重新下载, fn:%s, idx:%d\n", d.remote, idx)
+		os.Remove(d.partName(idx))
+		d.refProgress(-info.Size())
+		pending = append(pending, idx)
+	}
+	return pending
+}
+
+// verify 校验拆分块的sha256
+func (d *download) verify(idx int) bool {
+	fp, err := os.Open(d.partName(idx))
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return false
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)) == d.sums[idx]
+}
+
+// fetchPart 从临时文件的大小开始续传拆分块
+// 协议：part {file_name} {chunk_index} offset={n}
+// 返回：先返回一行{n}，失败时为fail，然后返回n个字节
+func (d *download) fetchPart(idx int) {
+	fp, err := os.OpenFile(d.partName(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		d.c.logf("打开拆分块临时文件失败, idx:%d, err:%s\n", idx, err)
+		return
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return
+	}
+	off := info.Size()
+	if off >= d.chunkSize(idx) {
+		return
+	}
+	// 拆分块下载新建连接
+	conn, err := d.c.connLogin()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err = d.c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("part %s %d offset=%d", d.remote, idx, off))); err != nil {
+		return
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		d.c.logf("获取拆分块失败, idx:%d, err:%s\n", idx, err)
+		return
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil || n != d.chunkSize(idx)-off {
+		d.c.logf("获取拆分块失败, idx:%d, res:%s\n", idx, strings.TrimSpace(line))
+		return
+	}
+	if _, err = io.CopyN(&progressWriter{fp, d}, br, n); err != nil {
+		d.c.logf("下载拆分块中断, idx:%d, err:%s\n", idx, err)
+		return
+	}
+	if err = fp.Sync(); err != nil {
+		d.c.logf("拆分块落盘失败, idx:%d, err:%s\n", idx, err)
+	}
+}
+
+// progressWriter 写入拆分块临时文件时更新下载进度
+type progressWriter struct {
+	w io.Writer
+	d *download
+}
+
+// Write 写入数据并更新进度
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.d.refProgress(int64(n))
+	return n, err
+}
+
+// refProgress 更新已下载大小，刷新进度，组装完成前最多为99
+func (d *download) refProgress(n int64) {
+	size := atomic.AddInt64(&d.done, n)
+	if d.prochan == nil || d.size == 0 {
+		return
+	}
+	percent := size * 100 / d.size
+	if percent > 99 {
+		percent = 99
+	}
+	d.prochan <- int(percent)
+}
+
+// copyPart 把第idx个拆分块写入w，端到端加密的文件写入解密后的数据，返回写入的字节数
+func (d *download) copyPart(w io.Writer, idx int) (int64, error) {
+	if d.aead == nil {
+		part, err := os.Open(d.partName(idx))
+		if err != nil {
+			return 0, err
+		}
+		defer part.Close()
+		return io.Copy(w, part)
+	}
+	sealed, err := os.ReadFile(d.partName(idx))
+	if err != nil {
+		return 0, err
+	}
+	plain, err := d.aead.Open(sealed[:0], d.meta.chunkNonce(idx), sealed, nil)
+	if err != nil {
+		return 0, fmt.Errorf("解密失败, idx:%d, err:%s", idx, err)
+	}
+	n, err := w.Write(plain)
+	return int64(n), err
+}
+
+// assemble 按序号拼接拆分块到隐藏的临时文件，落盘后重命名为dst，并删除临时目录
+func (d *download) assemble() error {
+	fp, err := os.CreateTemp(filepath.Dir(d.dst), "."+filepath.Base(d.dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+	defer os.Remove(tmp)
+	defer fp.Close()
+	var total int64
+	for idx := range d.sums {
+		n, err := d.copyPart(fp, idx)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	if d.aead != nil && total != d.plain {
+		return fmt.Errorf("解密后大小错误, size:%d, total:%d", d.plain, total)
+	}
+	// CreateTemp创建的文件权限为0600，改为与DownloadVersion相同的权限
+	if err = fp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if !d.mtime.IsZero() {
+		if err = os.Chtimes(tmp, d.mtime, d.mtime); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, d.dst); err != nil {
+		return err
+	}
+	d.c.logf("下载完成, fn:%s, dst:%s, size:%d\n", d.remote, d.dst, total)
+	return os.RemoveAll(d.dir)
+}
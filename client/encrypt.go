@@ -0,0 +1,213 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// encAlg 端到端加密算法
+	encAlg = "aes-gcm"
+	// kdfIter 根据口令派生密钥的迭代次数
+	kdfIter = 200000
+	// encOverhead 每个拆分文件加密后增加的字节数
+	encOverhead = 16
+)
+
+// Passphrase 端到端加密口令，非空时客户端加密文件内容后再上传，服务端只保存密文
+var Passphrase = ""
+
+// cipherMeta 端到端加密元数据，随文件保存在服务端
+// 格式：aes-gcm:{iter}:{salt}:{nonce}:{verify}
+type cipherMeta struct {
+	iter   int    // 密钥派生迭代次数
+	salt   []byte // 密钥派生盐值
+	nonce  []byte // nonce前缀，后8个字节为拆分文件序号
+	verify []byte // 口令校验值
+}
+
+// newCipherMeta 生成新的加密元数据
+func newCipherMeta() (*cipherMeta, error) {
+	meta := &cipherMeta{iter: kdfIter, salt: make([]byte, 16), nonce: make([]byte, 4)}
+	if _, err := rand.Read(meta.salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(meta.nonce); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// parseCipherMeta 解析加密元数据
+func parseCipherMeta(s string) (*cipherMeta, error) {
+	arr := strings.Split(s, ":")
+	if len(arr) != 5 || arr[0] != encAlg {
+		return nil, fmt.Errorf("cipher meta error: %s", s)
+	}
+	iter, err := strconv.Atoi(arr[1])
+	if err != nil {
+		return nil, err
+	}
+	meta := &cipherMeta{iter: iter}
+	if meta.salt, err = hex.DecodeString(arr[2]); err != nil {
+		return nil, err
+	}
+	if meta.nonce, err = hex.DecodeString(arr[3]); err != nil {
+		return nil, err
+	}
+	if len(meta.nonce) != 4 {
+		return nil, fmt.Errorf("cipher meta error: %s", s)
+	}
+	if arr[4] != "" {
+		if meta.verify, err = hex.DecodeString(arr[4]); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// String 返回元数据的协议格式
+func (meta *cipherMeta) String() string {
+	return fmt.Sprintf("%s:%d:%x:%x:%x", encAlg, meta.iter, meta.salt, meta.nonce, meta.verify)
+}
+
+// aead 根据口令派生密钥，元数据中没有校验值时写入校验值，有则校验口令是否正确
+func (meta *cipherMeta) aead(pass string) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, pass, meta.salt, meta.iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("verify"), key...))
+	if meta.verify == nil {
+		meta.verify = sum[:8]
+	} else if !bytes.Equal(meta.verify, sum[:8]) {
+		return nil, fmt.Errorf("口令错误")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce 拆分文件的nonce：前缀+序号
+func (meta *cipherMeta) chunkNonce(idx int) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, meta.nonce)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(idx))
+	return nonce
+}
+
+// sealChunk 读取并加密第idx个拆分文件
+// 同一个会话中重复加密的结果相同，因此可以按密文位置续传
+func (cli *upload) sealChunk(fp *os.File, idx int) ([]byte, int64, error) {
+	off := int64(idx) * cli.ssize
+	plen := cli.ssize
+	if cli.tsize-off < plen {
+		plen = cli.tsize - off
+	}
+	plain := make([]byte, plen)
+	if _, err := fp.ReadAt(plain, off); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return cli.aead.Seal(nil, cli.meta.chunkNonce(idx), plain, nil), plen, nil
+}
+
+// writeSealed 从续传位置开始发送加密后的拆分文件
+func (cli *upload) writeSealed(w io.Writer, fp *os.File, idx int, ctn int64) error {
+	sealed, plen, err := cli.sealChunk(fp, idx)
+	if err != nil {
+		cli.c.logf("加密拆分文件失败, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+		return err
+	}
+	for ctn < int64(len(sealed)) {
+		end := ctn + 1024
+		if end > int64(len(sealed)) {
+			end = int64(len(sealed))
+		}
+		if _, err = w.Write(sealed[ctn:end]); err != nil {
+			cli.c.logf("写文件到net buffer错误, uid:%s, idx:%d, err:%s\n", cli.uid, idx, err)
+			return err
+		}
+		// 进度按明文大小计算
+		cli.refProgress(min(end, plen) - min(ctn, plen))
+		ctn = end
+	}
+	return nil
+}
+
+// DecryptFile 解密从服务端取回的加密文件
+// 加密元数据保存在src同目录的{src}.enc文件中
+func DecryptFile(src, dst, pass string) error {
+	b, err := os.ReadFile(src + ".enc")
+	if err != nil {
+		return err
+	}
+	opts, err := analyzeOpts(strings.Fields(string(b)))
+	if err != nil {
+		return err
+	}
+	meta, err := parseCipherMeta(opts["enc"])
+	if err != nil {
+		return err
+	}
+	ssize, err := strconv.ParseInt(opts["chunk"], 10, 64)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(opts["size"], 10, 64)
+	if err != nil {
+		return err
+	}
+	aead, err := meta.aead(pass)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return decryptChunks(out, in, meta, aead, ssize, size)
+}
+
+// decryptChunks 按上传时的拆分文件逐个解密in中的密文并写入out
+// ssize为拆分文件的明文大小，size为明文总大小
+func decryptChunks(out io.Writer, in io.Reader, meta *cipherMeta, aead cipher.AEAD, ssize, size int64) error {
+	buf := make([]byte, ssize+encOverhead)
+	var total int64
+	for idx := 0; total < size; idx++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("密文不完整, idx:%d, err:%s", idx, err)
+		}
+		plain, err := aead.Open(buf[:0], meta.chunkNonce(idx), buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("解密失败, idx:%d, err:%s", idx, err)
+		}
+		if _, err = out.Write(plain); err != nil {
+			return err
+		}
+		total += int64(len(plain))
+	}
+	if total != size {
+		return fmt.Errorf("解密后大小错误, size:%d, total:%d", size, total)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newSealUpload 创建加密上传fn的会话，拆分文件大小为ssize
+func newSealUpload(t *testing.T, fn string, ssize int64) *upload {
+	t.Helper()
+	info, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := newCipherMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 减少迭代次数加快测试
+	meta.iter = 1000
+	aead, err := meta.aead("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &upload{
+		c:       NewClient("", "", ""),
+		fn:      fn,
+		tsize:   info.Size(),
+		ssize:   ssize,
+		meta:    meta,
+		aead:    aead,
+		prochan: make(chan int, 10000),
+	}
+}
+
+func TestSealResume(t *testing.T) {
+	data := make([]byte, 2500)
+	rand.Read(data)
+	fn := filepath.Join(t.TempDir(), "a.bin")
+	os.WriteFile(fn, data, 0644)
+	fp, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	cli := newSealUpload(t, fn, 1000)
+	// 每个拆分文件从不同的密文位置续传：开头、拆分文件中间、1024字节的发送块边界和最后一个字节
+	resumes := []int64{0, 517, 1015}
+	var stored bytes.Buffer
+	for idx, ctn := range resumes {
+		sealed, plen, err := cli.sealChunk(fp, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := min(cli.ssize, cli.tsize-int64(idx)*cli.ssize); plen != want || int64(len(sealed)) != plen+encOverhead {
+			t.Fatalf("chunk %d: plain %d, sealed %d", idx, plen, len(sealed))
+		}
+		ctn = min(ctn, int64(len(sealed))-1)
+		// 中断前已经上传的密文，续传时重新加密的结果必须相同
+		stored.Write(sealed[:ctn])
+		if err = cli.writeSealed(&stored, fp, idx, ctn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := cli.tsize + int64(len(resumes))*encOverhead; int64(stored.Len()) != want {
+		t.Fatalf("stored %d bytes, want %d", stored.Len(), want)
+	}
+	var plain bytes.Buffer
+	if err = decryptChunks(&plain, bytes.NewReader(stored.Bytes()), cli.meta, cli.aead, cli.ssize, cli.tsize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), data) {
+		t.Fatalf("decrypted data mismatch")
+	}
+	// 密文被篡改或者拆分文件顺序错误时解密失败
+	tampered := bytes.Clone(stored.Bytes())
+	tampered[1500] ^= 1
+	if err = decryptChunks(&bytes.Buffer{}, bytes.NewReader(tampered), cli.meta, cli.aead, cli.ssize, cli.tsize); err == nil {
+		t.Fatalf("tampered chunk decrypted")
+	}
+	swapped := append(bytes.Clone(stored.Bytes()[1016:2032]), stored.Bytes()[:1016]...)
+	swapped = append(swapped, stored.Bytes()[2032:]...)
+	if err = decryptChunks(&bytes.Buffer{}, bytes.NewReader(swapped), cli.meta, cli.aead, cli.ssize, cli.tsize); err == nil {
+		t.Fatalf("swapped chunks decrypted")
+	}
+}
+
+func TestDecryptFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, 1000, 1001, 3000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		fn := filepath.Join(dir, fmt.Sprintf("plain%d", size))
+		os.WriteFile(fn, data, 0644)
+		fp, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli := newSealUpload(t, fn, 1000)
+		var stored bytes.Buffer
+		for idx := 0; int64(idx)*cli.ssize < cli.tsize; idx++ {
+			if err = cli.writeSealed(&stored, fp, idx, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fp.Close()
+		// 取回的密文和服务端保存的.enc元数据
+		src := filepath.Join(dir, fmt.Sprintf("cipher%d", size))
+		os.WriteFile(src, stored.Bytes(), 0644)
+		os.WriteFile(src+".enc", []byte(fmt.Sprintf("enc=%s chunk=%d size=%d", cli.meta, cli.ssize, cli.tsize)), 0644)
+		dst := filepath.Join(dir, fmt.Sprintf("out%d", size))
+		if err = DecryptFile(src, dst, "secret"); err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+			t.Fatalf("size %d: decrypted data mismatch", size)
+		}
+		if err = DecryptFile(src, dst, "wrong"); err == nil {
+			t.Fatalf("size %d: decrypted with wrong passphrase", size)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PreserveXattrs 是否上传源文件的扩展属性，服务端只保存user.命名空间的扩展属性
+var PreserveXattrs = false
+
+// maxXattrLen 编码后扩展属性的最大长度，超过时不上传扩展属性
+const maxXattrLen = 16 * 1024
+
+// fileMeta 返回源文件元数据的协议格式：mtime={unix_nano} mode={octal} [xattr={name}:{value},...]
+// 扩展属性的名称和值使用base64 url编码（无填充）
+func (c *Client) fileMeta(fn string) (string, error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	meta := fmt.Sprintf("mtime=%d mode=%o", info.ModTime().UnixNano(), info.Mode().Perm())
+	if !c.PreserveXattrs {
+		return meta, nil
+	}
+	xattrs, err := listXattrs(fn)
+	if err != nil {
+		c.logf("读取扩展属性错误, fn:%s, err:%s\n", fn, err)
+		return meta, nil
+	}
+	var pairs []string
+	for name, value := range xattrs {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		pairs = append(pairs, base64.RawURLEncoding.EncodeToString([]byte(name))+":"+base64.RawURLEncoding.EncodeToString(value))
+	}
+	if len(pairs) == 0 {
+		return meta, nil
+	}
+	sort.Strings(pairs)
+	xattr := strings.Join(pairs, ",")
+	if len(xattr) > maxXattrLen {
+		c.logf("扩展属性过大，不上传扩展属性, fn:%s, size:%d\n", fn, len(xattr))
+		return meta, nil
+	}
+	return meta + " xattr=" + xattr, nil
+}
@@ -3,21 +3,24 @@ package client
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// login 登陆服务器,成功返true
-func login(conn net.Conn, usr, pw string) (bool, error) {
-	loginStr := fmt.Sprintf("login %s %s", usr, pw)
-	err := writeBufferTimeOut(conn, []byte(loginStr))
+// ErrBadPath 文件名不合法，服务端拒绝处理
+var ErrBadPath = fmt.Errorf("bad path")
+
+// login 使用客户端的用户名和密码登陆服务器,成功返true
+func (c *Client) login(conn net.Conn) (bool, error) {
+	loginStr := fmt.Sprintf("login %s %s", c.User, c.Password)
+	err := c.writeBufferTimeOut(conn, []byte(loginStr))
 	if err != nil {
-		log.Printf("发送登陆信息到服务端失败, login:%s, err:%s\n", loginStr, err)
+		c.logf("发送登陆信息到服务端失败, login:%s, err:%s\n", loginStr, err)
 		return false, err
 	}
-	buf, n, err := readBufferTimeOut(conn)
+	buf, n, err := c.readBufferTimeOut(conn)
 	if err != nil {
 		return false, err
 	}
@@ -28,67 +31,204 @@ func login(conn net.Conn, usr, pw string) (bool, error) {
 	case "fail":
 		return false, nil
 	default:
-		log.Printf("登陆返回协议错误, res:%s\n", res)
+		c.logf("登陆返回协议错误, res:%s\n", res)
 		return false, nil
 	}
 }
 
 // splitScheme 从服务端获取拆分方案
-func (cli *client) splitScheme() error {
-	upStr := fmt.Sprintf("big %s %d", cli.fn, cli.tsize)
-	if err := writeBufferTimeOut(cli.conn, []byte(upStr)); err != nil {
+// 协议：big {file_name} {file_size} [compress={name,...}] [enc={meta} overhead={n}] [conflict={policy} [sha256={sum}]] [session={id}] [holes={off}+{len},...] source={fingerprint} mtime={unix_nano} mode={octal} [xattr={...}]
+// 返回：{file_size} {session_id} [compress={name}] [enc={meta} overhead={n}] [name={file.name}] [expire={unix}] [expired=1] [sparse=1] [changed=1]
+// 服务端返回sparse=1时全部在空洞中的拆分文件不上传，返回changed=1时续传的源文件与之前不一致
+// 续传时服务端返回之前保存的加密元数据，同名文件冲突时返回exists或identical，文件名不合法时返回badpath，存储空间不足时返回nospace
+// 指定session时续传这个会话，会话不存在时服务端返回新的会话id
+func (cli *upload) splitScheme() error {
+	upStr := fmt.Sprintf("big %s %d", cli.remote, cli.tsize)
+	if cli.c.Conflict != "" {
+		upStr += " conflict=" + cli.c.Conflict
+		if cli.c.Conflict == "skip" {
+			sum, err := fileSum(cli.fn)
+			if err != nil {
+				cli.c.logf("计算文件sha256错误, fn:%s, err:%s\n", cli.fn, err)
+				return err
+			}
+			upStr += " sha256=" + sum
+		}
+	}
+	if cli.c.Passphrase != "" {
+		// 密文不可压缩，加密时不提供压缩算法
+		meta, err := newCipherMeta()
+		if err != nil {
+			return err
+		}
+		if _, err = meta.aead(cli.c.Passphrase); err != nil {
+			return err
+		}
+		upStr += fmt.Sprintf(" enc=%s overhead=%d", meta, encOverhead)
+	} else {
+		if offer := cli.c.compressOffer(cli.fn); offer != "" {
+			upStr += " compress=" + offer
+		}
+		// 加密后空洞的密文不是0，只在不加密时发送空洞
+		if cli.holes = cli.c.fileHoles(cli.fn, cli.tsize); len(cli.holes) > 0 {
+			upStr += " holes=" + encodeHoles(cli.holes)
+		}
+	}
+	if cli.session != "" {
+		upStr += " session=" + cli.session
+	}
+	source, err := sourceFingerprint(cli.fn)
+	if err != nil {
+		cli.c.logf("计算源文件指纹错误, fn:%s, err:%s\n", cli.fn, err)
 		return err
 	}
-	buf, n, err := readBufferTimeOut(cli.conn)
+	upStr += " source=" + source
+	meta, err := cli.c.fileMeta(cli.fn)
+	if err != nil {
+		cli.c.logf("读取文件元数据错误, fn:%s, err:%s\n", cli.fn, err)
+		return err
+	}
+	upStr += " " + meta
+	if err := cli.c.writeOp(cli.conn, upStr); err != nil {
+		return err
+	}
+	buf, n, err := cli.c.readBufferTimeOut(cli.conn)
 	if err != nil {
 		return err
 	}
 	schemeStr := string(buf[:n])
+	switch strings.TrimSpace(schemeStr) {
+	case "exists":
+		cli.c.logf("服务端已存在同名文件，拒绝上传, remote:%s\n", cli.remote)
+		return ErrExists
+	case "identical":
+		cli.c.logf("服务端已存在相同的文件，跳过上传, remote:%s\n", cli.remote)
+		return errIdentical
+	case "badpath":
+		cli.c.logf("文件名不合法, remote:%s\n", cli.remote)
+		return ErrBadPath
+	case "nospace":
+		cli.c.logf("服务端存储空间不足, remote:%s, size:%d\n", cli.remote, cli.tsize)
+		return errNoSpace
+	}
 	scheme := strings.Split(schemeStr, " ")
-	if len(scheme) != 2 {
-		log.Printf("拆分协议错误, scheme:%s\n", schemeStr)
+	if len(scheme) < 2 {
+		cli.c.logf("拆分协议错误, scheme:%s\n", schemeStr)
 		return fmt.Errorf("protocol error")
 	}
 	ssize, err := strconv.ParseInt(scheme[0], 10, 64)
 	if err != nil {
-		log.Printf("拆分协议错误, scheme:%s, err:%s\n", schemeStr, err)
+		cli.c.logf("拆分协议错误, scheme:%s, err:%s\n", schemeStr, err)
+		return err
+	}
+	opts, err := analyzeOpts(scheme[2:])
+	if err != nil {
+		cli.c.logf("拆分协议错误, scheme:%s, err:%s\n", schemeStr, err)
 		return err
 	}
 	cli.ssize = ssize
 	cli.uid = scheme[1]
+	if opts["expired"] == "1" {
+		cli.c.logf("上传会话已过期，服务端已删除临时数据，重新上传整个文件, session:%s, uid:%s\n", cli.session, cli.uid)
+	} else if cli.session != "" && cli.session != cli.uid {
+		cli.c.logf("上传会话不存在，新建上传会话, session:%s, uid:%s\n", cli.session, cli.uid)
+	}
+	cli.c.logf("上传会话, uid:%s, remote:%s\n", cli.uid, cli.remote)
+	cli.compress = opts["compress"]
+	if opts["expire"] != "" {
+		if unix, err := strconv.ParseInt(opts["expire"], 10, 64); err == nil {
+			cli.c.logf("上传会话空闲时的过期时间:%s, uid:%s\n", time.Unix(unix, 0).Format("2006-01-02 15:04:05"), cli.uid)
+		}
+	}
+	if opts["sparse"] == "1" {
+		cli.markHoles()
+		cli.c.logf("服务端接受文件空洞, uid:%s, 不上传的拆分文件:%d\n", cli.uid, len(cli.holeIdx))
+	}
+	if opts["changed"] == "1" {
+		cli.changed = true
+		cli.c.logf("源文件在上传中断后发生变化，校验已上传的拆分文件, uid:%s, fn:%s\n", cli.uid, cli.fn)
+	}
+	if opts["name"] != "" {
+		cli.c.logf("服务端已存在同名文件，重命名为:%s, remote:%s\n", opts["name"], cli.remote)
+	}
+	if cli.c.Passphrase != "" {
+		// 服务端不支持加密时不能上传明文
+		if opts["enc"] == "" {
+			cli.c.logf("服务端不支持端到端加密, scheme:%s\n", schemeStr)
+			return fmt.Errorf("encryption unsupported")
+		}
+		if cli.meta, err = parseCipherMeta(opts["enc"]); err != nil {
+			cli.c.logf("加密元数据错误, scheme:%s, err:%s\n", schemeStr, err)
+			return err
+		}
+		if cli.aead, err = cli.meta.aead(cli.c.Passphrase); err != nil {
+			cli.c.logf("加密口令校验失败, uid:%s, err:%s\n", cli.uid, err)
+			return err
+		}
+	}
 	return nil
 }
 
-// readBufferTimeOut 从缓冲区读取字节，过期两秒
-func readBufferTimeOut(conn net.Conn) ([]byte, int, error) {
-	// conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-	return readBuffer(conn)
+// analyzeOpts 解析可选参数，格式：{key}={value}
+func analyzeOpts(optArr []string) (map[string]string, error) {
+	opts := make(map[string]string, len(optArr))
+	for _, opt := range optArr {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("option error: %s", opt)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	return opts, nil
+}
+
+// readBufferTimeOut 从缓冲区读取字节，超时时间由连接设置，见Client.Timeout
+func (c *Client) readBufferTimeOut(conn net.Conn) ([]byte, int, error) {
+	return c.readBuffer(conn)
 }
 
 // readBuffer 从缓冲区读取字节
-func readBuffer(conn net.Conn) ([]byte, int, error) {
+func (c *Client) readBuffer(conn net.Conn) ([]byte, int, error) {
 	var buf = make([]byte, 1000)
 	n, err := conn.Read(buf)
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("从buffer中读取错误, %s\n", err)
+			c.logf("从buffer中读取错误, %s\n", err)
 		}
 		return nil, 0, err
 	}
 	return buf, n, nil
 }
 
-// writeBufferTimeOut 写数据到缓冲区，过期两秒
-func writeBufferTimeOut(conn net.Conn, content []byte) error {
-	// conn.SetWriteDeadline(time.Now().Add(time.Second * 2))
-	return writeBuffer(conn, content)
+const (
+	// maxBufLen 服务端一次读取的最大长度
+	maxBufLen = 1000
+	// maxOpLen 分帧发送的操作请求的最大长度，与服务端一致
+	maxOpLen = 64 * 1024
+)
+
+// writeOp 发送操作请求，超过服务端一次读取的长度时分帧发送：先发送一行请求的字节数{n}，然后发送n个字节
+func (c *Client) writeOp(conn net.Conn, op string) error {
+	if len(op) > maxOpLen {
+		c.logf("请求过长, size:%d\n", len(op))
+		return fmt.Errorf("request too long")
+	}
+	if len(op) > maxBufLen {
+		op = fmt.Sprintf("%d\n%s", len(op), op)
+	}
+	return c.writeBufferTimeOut(conn, []byte(op))
+}
+
+// writeBufferTimeOut 写数据到缓冲区，超时时间由连接设置，见Client.Timeout
+func (c *Client) writeBufferTimeOut(conn net.Conn, content []byte) error {
+	return c.writeBuffer(conn, content)
 }
 
 // writeBuffer 写数据到缓冲区
-func writeBuffer(conn net.Conn, content []byte) error {
+func (c *Client) writeBuffer(conn net.Conn, content []byte) error {
 	_, err := conn.Write(content)
 	if err != nil {
-		log.Printf("写入buffer失败, content:%s, %s\n", string(content), err)
+		c.logf("写入buffer失败, content:%s, %s\n", string(content), err)
 		return err
 	}
 	return nil
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteFile 服务端的文件或者目录
+type RemoteFile struct {
+	Name    string    // 名称，List返回目录中的名称，Stat返回服务端文件名
+	Dir     bool      // 是否是目录
+	Size    int64     // 文件大小，目录为0
+	ModTime time.Time // 修改时间，保留源文件修改时间时为源文件的修改时间
+	Sum     string    // 文件内容的sha256，只有Stat返回
+}
+
+// List 使用包变量的配置列出服务端目录，见Client.List
+func List(dir string) ([]RemoteFile, error) {
+	return defaultClient().List(dir)
+}
+
+// List 列出服务端目录中的文件和子目录，dir为空或者/时为用户目录
+func (c *Client) List(dir string) ([]RemoteFile, error) {
+	if dir == "" {
+		dir = "/"
+	}
+	conn, err := c.connLogin()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("list %s 0", dir))); err != nil {
+		return nil, err
+	}
+	// 服务端发送完成后关闭连接
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch string(b) {
+	case "badpath\n":
+		return nil, ErrBadPath
+	case "fail\n":
+		return nil, fmt.Errorf("列出目录失败")
+	}
+	var files []RemoteFile
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		// name在最后，可能包含=
+		i := strings.Index(line, " name=")
+		if i < 0 {
+			c.logf("列出目录协议错误, line:%s\n", line)
+			return nil, fmt.Errorf("protocol error")
+		}
+		opts, err := analyzeOpts(strings.Fields(line[:i]))
+		if err != nil {
+			c.logf("列出目录协议错误, line:%s, err:%s\n", line, err)
+			return nil, err
+		}
+		f := RemoteFile{Name: line[i+len(" name="):], Dir: opts["type"] == "d"}
+		f.Size, _ = strconv.ParseInt(opts["size"], 10, 64)
+		if ns, _ := strconv.ParseInt(opts["mtime"], 10, 64); ns != 0 {
+			f.ModTime = time.Unix(0, ns)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Stat 使用包变量的配置查询服务端文件，见Client.Stat
+func Stat(fn string) (*RemoteFile, error) {
+	return defaultClient().Stat(fn)
+}
+
+// Stat 查询服务端文件的大小、修改时间和sha256，文件不存在时返回ErrNotFound
+func (c *Client) Stat(fn string) (*RemoteFile, error) {
+	res, err := c.remoteOp(fmt.Sprintf("stat %s 0", fn))
+	if err != nil {
+		return nil, err
+	}
+	if res == "notfound" {
+		return nil, ErrNotFound
+	}
+	opts, err := analyzeOpts(strings.Fields(res))
+	if err != nil || opts["sha256"] == "" {
+		return nil, fmt.Errorf("查询文件失败: %s", res)
+	}
+	f := &RemoteFile{Name: fn, Sum: opts["sha256"]}
+	f.Size, _ = strconv.ParseInt(opts["size"], 10, 64)
+	if ns, err := strconv.ParseInt(opts["mtime"], 10, 64); err == nil {
+		f.ModTime = time.Unix(0, ns)
+	}
+	return f, nil
+}
+
+// Delete 使用包变量的配置删除服务端文件，见Client.Delete
+func Delete(fn string) error {
+	return defaultClient().Delete(fn)
+}
+
+// Delete 删除服务端文件以及它的历史版本，文件不存在时返回ErrNotFound
+func (c *Client) Delete(fn string) error {
+	res, err := c.remoteOp(fmt.Sprintf("delete %s 0", fn))
+	if err != nil {
+		return err
+	}
+	switch res {
+	case "success":
+		return nil
+	case "notfound":
+		return ErrNotFound
+	default:
+		return fmt.Errorf("删除文件失败: %s", res)
+	}
+}
+
+// Move 使用包变量的配置移动服务端文件，见Client.Move
+func Move(from, to string) error {
+	return defaultClient().Move(from, to)
+}
+
+// Move 把服务端文件移动到to，历史版本一起移动，from不存在时返回ErrNotFound，to已存在时返回ErrExists
+func (c *Client) Move(from, to string) error {
+	res, err := c.remoteOp(fmt.Sprintf("move %s 0 to=%s", from, to))
+	if err != nil {
+		return err
+	}
+	switch res {
+	case "success":
+		return nil
+	case "notfound":
+		return ErrNotFound
+	case "exists":
+		return ErrExists
+	default:
+		return fmt.Errorf("移动文件失败: %s", res)
+	}
+}
+
+// remoteOp 发送一个操作并返回服务端的结果，文件名不合法时返回ErrBadPath
+func (c *Client) remoteOp(op string) (string, error) {
+	conn, err := c.connLogin()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(op)); err != nil {
+		return "", err
+	}
+	buf, n, err := c.readBufferTimeOut(conn)
+	if err != nil {
+		return "", err
+	}
+	res := strings.TrimSpace(string(buf[:n]))
+	if res == "badpath" {
+		return "", ErrBadPath
+	}
+	return res, nil
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// 未完成的上传会话，key={服务端地址} {用户名} {本地文件名} {服务端文件名} {文件大小} {修改时间}，value=会话id
+// 上传失败后重新上传同一个文件时，使用之前的会话id续传，所有Client共享，按服务端地址和用户区分
+var sessions sync.Map
+
+// sessionKey 返回本地文件上传到服务端文件名的会话key，文件修改后不再续传
+func (c *Client) sessionKey(fn, remote string) (string, error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s %s %d %d", c.Addr, c.User, fn, remote, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// Session 返回使用包变量的配置上传时未完成的上传会话id，见Client.Session
+func Session(fn, dst string) string {
+	return defaultClient().Session(fn, dst)
+}
+
+// Session 返回本地文件上传到dst的未完成的上传会话id，没有时返回空字符串
+// 客户端重启后可以使用ResumeUpload续传
+func (c *Client) Session(fn, dst string) string {
+	key, err := c.sessionKey(fn, remoteName(fn, dst))
+	if err != nil {
+		return ""
+	}
+	if id, ok := sessions.Load(key); ok {
+		return id.(string)
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fingerprintSample 计算源文件指纹时每个采样区域的大小
+const fingerprintSample = 64 * 1024
+
+// sourceFingerprint 返回源文件的指纹，续传时服务端据此判断源文件是否变化
+// 指纹为文件大小、修改时间以及开头、中间、结尾各64KB内容的sha256（前16字节的hex编码），不需要读取整个文件
+func sourceFingerprint(fn string) (string, error) {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d\n", info.Size(), info.ModTime().UnixNano())
+	for _, off := range []int64{0, info.Size()/2 - fingerprintSample/2, info.Size() - fingerprintSample} {
+		if off < 0 {
+			off = 0
+		}
+		if _, err = io.Copy(h, io.NewSectionReader(fp, off, fingerprintSample)); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:16]), nil
+}
+
+// maxResetLen 一次reset请求中拆分文件序号的最大长度，请求需要在一次读取中发送
+const maxResetLen = 800
+
+// verifySource 源文件变化后按sha256校验已上传的拆分文件
+// 没有上传完整的拆分文件无法校验，与校验不一致的拆分文件一起清空后重新上传
+func (cli *upload) verifySource() error {
+	states, err := cli.chunkStatus(true)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(cli.fn)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var resets []string
+	for i, st := range states {
+		if cli.holeIdx[i] || st.received == 0 {
+			continue
+		}
+		if st.sum != "" {
+			sum, err := cli.chunkSum(fp, i)
+			if err != nil {
+				return err
+			}
+			if sum == st.sum {
+				continue
+			}
+		}
+		resets = append(resets, strconv.Itoa(i))
+	}
+	cli.c.logf("校验已上传的拆分文件, uid:%s, 需要重新上传:%d\n", cli.uid, len(resets))
+	// 序号较多时分多次发送，最后一次携带done=1
+	for {
+		var batch []string
+		size := 0
+		for len(resets) > 0 && size+len(resets[0])+1 <= maxResetLen {
+			size += len(resets[0]) + 1
+			batch, resets = append(batch, resets[0]), resets[1:]
+		}
+		if err = cli.resetChunks(batch, len(resets) == 0); err != nil {
+			return err
+		}
+		if len(resets) == 0 {
+			return nil
+		}
+	}
+}
+
+// chunkSum 计算本地拆分文件发送给服务端的数据的sha256，端到端加密时为密文
+func (cli *upload) chunkSum(fp *os.File, idx int) (string, error) {
+	h := sha256.New()
+	if cli.aead != nil {
+		sealed, _, err := cli.sealChunk(fp, idx)
+		if err != nil {
+			return "", err
+		}
+		h.Write(sealed)
+	} else if _, err := io.Copy(h, io.NewSectionReader(fp, int64(idx)*cli.ssize, cli.chunkSize(idx))); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// resetChunks 在主连接上清空拆分文件，done为true时通知服务端校验结束
+// 协议：reset {unique_id} 0 [idx={i,...}] [done=1]
+// 返回：success或者fail
+func (cli *upload) resetChunks(idxs []string, done bool) error {
+	op := fmt.Sprintf("reset %s 0", cli.uid)
+	if len(idxs) > 0 {
+		op += " idx=" + strings.Join(idxs, ",")
+	}
+	if done {
+		op += " done=1"
+	}
+	if err := cli.c.writeBufferTimeOut(cli.conn, []byte(op)); err != nil {
+		return err
+	}
+	buf, n, err := cli.c.readBufferTimeOut(cli.conn)
+	if err != nil {
+		return err
+	}
+	if res := string(buf[:n]); res != "success" {
+		cli.c.logf("清空拆分文件失败, uid:%s, res:%s\n", cli.uid, res)
+		return fmt.Errorf("reset fail")
+	}
+	return nil
+}
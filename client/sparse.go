@@ -0,0 +1,75 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxHolesLen 编码后空洞的最大长度，超过时只发送最大的空洞，其余空洞作为数据上传
+const maxHolesLen = 16 * 1024
+
+// extent 文件中的一段连续区域
+type extent struct {
+	off  int64 // 起始偏移
+	size int64 // 长度
+}
+
+// fileHoles 返回文件的空洞，按偏移排序，不支持时返回nil
+func (c *Client) fileHoles(fn string, size int64) []extent {
+	fp, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close()
+	holes, err := holeExtents(fp, size)
+	if err != nil {
+		c.logf("检测文件空洞错误, fn:%s, err:%s\n", fn, err)
+		return nil
+	}
+	if len(encodeHoles(holes)) <= maxHolesLen {
+		return holes
+	}
+	// 空洞过多时保留最大的空洞
+	sort.Slice(holes, func(i, j int) bool { return holes[i].size > holes[j].size })
+	var kept []extent
+	n := 0
+	for _, h := range holes {
+		l := len(fmt.Sprintf("%d+%d,", h.off, h.size))
+		if n+l > maxHolesLen {
+			break
+		}
+		kept = append(kept, h)
+		n += l
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].off < kept[j].off })
+	return kept
+}
+
+// encodeHoles 编码文件的空洞：{off}+{len},...
+func encodeHoles(holes []extent) string {
+	strs := make([]string, 0, len(holes))
+	for _, h := range holes {
+		strs = append(strs, fmt.Sprintf("%d+%d", h.off, h.size))
+	}
+	return strings.Join(strs, ",")
+}
+
+// markHoles 标记全部在空洞中的拆分文件，与服务端的规则相同，这些拆分文件不上传
+func (cli *upload) markHoles() {
+	cli.holeIdx = make(map[int]bool)
+	num := cli.fileNum()
+	for _, h := range cli.holes {
+		for i := int((h.off + cli.ssize - 1) / cli.ssize); i < num; i++ {
+			end := int64(i+1) * cli.ssize
+			if end > cli.tsize {
+				end = cli.tsize
+			}
+			if end > h.off+h.size {
+				break
+			}
+			cli.holeIdx[i] = true
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package client
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek的SEEK_DATA和SEEK_HOLE
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// holeExtents 使用SEEK_DATA/SEEK_HOLE查找文件的空洞，文件系统不支持时返回nil
+func holeExtents(fp *os.File, size int64) ([]extent, error) {
+	var holes []extent
+	var off int64
+	for off < size {
+		data, err := fp.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// 之后没有数据
+			holes = append(holes, extent{off: off, size: size - off})
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data > off {
+			holes = append(holes, extent{off: off, size: data - off})
+		}
+		if off, err = fp.Seek(data, seekHole); err != nil {
+			return nil, err
+		}
+	}
+	return holes, nil
+}
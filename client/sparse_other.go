@@ -0,0 +1,10 @@
+//go:build !linux
+
+package client
+
+import "os"
+
+// holeExtents 非linux系统不检测空洞
+func holeExtents(fp *os.File, size int64) ([]extent, error) {
+	return nil, nil
+}
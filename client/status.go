@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// chunkState 服务端拆分文件的接收状态
+type chunkState struct {
+	received int64  // 已接收的字节数
+	sum      string // 已接收完整时的sha256，查询时没有要求hash时为空
+}
+
+// chunkStatus 在主连接上查询上传会话每个拆分文件的接收状态
+// 协议：status {unique_id} 0 [hash=1]
+// 返回：先返回一行状态的字节数{n}，失败时为fail，然后返回n个字节，每个拆分文件一行：{idx} {received} [{sha256}]
+func (cli *upload) chunkStatus(hash bool) ([]chunkState, error) {
+	op := fmt.Sprintf("status %s 0", cli.uid)
+	if hash {
+		op += " hash=1"
+	}
+	if err := cli.c.writeBufferTimeOut(cli.conn, []byte(op)); err != nil {
+		return nil, err
+	}
+	// 服务端只回复这一个结果，缓冲读取不会读到之后的数据
+	br := bufio.NewReader(cli.conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		cli.c.logf("查询上传会话状态失败, uid:%s, res:%s\n", cli.uid, strings.TrimSpace(line))
+		return nil, fmt.Errorf("status fail")
+	}
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(br, buf); err != nil {
+		return nil, err
+	}
+	states := make([]chunkState, cli.fileNum())
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		idx, err := strconv.Atoi(fields[0])
+		if err != nil || idx < 0 || idx >= len(states) || len(fields) < 2 {
+			cli.c.logf("上传会话状态协议错误, line:%s\n", line)
+			return nil, fmt.Errorf("protocol error")
+		}
+		if states[idx].received, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, err
+		}
+		if len(fields) > 2 {
+			states[idx].sum = fields[2]
+		}
+	}
+	return states, nil
+}
+
+// pending 返回还没有上传完成的拆分文件，并把上传进度更新为服务端已接收的大小
+// 查询状态失败时返回所有拆分文件
+func (cli *upload) pending() []int {
+	fnum := cli.fileNum()
+	var idxs []int
+	states, err := cli.chunkStatus(false)
+	if err != nil {
+		cli.c.logf("查询上传会话状态失败，上传所有拆分文件, uid:%s, err:%s\n", cli.uid, err)
+		for i := 0; i < fnum; i++ {
+			idxs = append(idxs, i)
+		}
+		return idxs
+	}
+	var received int64
+	for i, st := range states {
+		// 端到端加密时服务端接收的是密文，进度按明文大小计算
+		size, expect := cli.chunkSize(i), cli.chunkSize(i)
+		if cli.aead != nil {
+			expect += encOverhead
+		}
+		received += min(st.received, size)
+		if st.received < expect {
+			idxs = append(idxs, i)
+		}
+	}
+	atomic.StoreInt64(&cli.usize, 0)
+	if cli.tsize > 0 {
+		cli.refProgress(received)
+	}
+	cli.c.logf("上传会话状态, uid:%s, 已接收:%d, 未完成的拆分文件:%d\n", cli.uid, received, len(idxs))
+	return idxs
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version 服务端保存的文件版本
+type Version struct {
+	ID      int       // 版本号
+	Time    time.Time // 上传完成时间
+	Session string    // 产生这个版本的上传会话
+	Size    int64     // 文件大小
+	Current bool      // 是否是当前版本
+}
+
+// ListVersions 使用包变量的配置查询文件的所有版本，见Client.ListVersions
+func ListVersions(fn string) ([]Version, error) {
+	return defaultClient().ListVersions(fn)
+}
+
+// ListVersions 查询服务端文件的所有版本，fn为服务端文件名
+func (c *Client) ListVersions(fn string) ([]Version, error) {
+	conn, err := c.connLogin()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("versions %s 0", fn))); err != nil {
+		return nil, err
+	}
+	// 服务端发送完成后关闭连接
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == "badpath\n" {
+		return nil, ErrBadPath
+	}
+	var vers []Version
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		opts, err := analyzeOpts(strings.Fields(line))
+		if err != nil {
+			c.logf("版本协议错误, line:%s, err:%s\n", line, err)
+			return nil, err
+		}
+		var v Version
+		if v.ID, err = strconv.Atoi(opts["id"]); err != nil {
+			return nil, err
+		}
+		unix, _ := strconv.ParseInt(opts["time"], 10, 64)
+		v.Time = time.Unix(unix, 0)
+		v.Session = opts["session"]
+		v.Size, _ = strconv.ParseInt(opts["size"], 10, 64)
+		v.Current = opts["current"] == "true"
+		vers = append(vers, v)
+	}
+	return vers, nil
+}
+
+// RestoreVersion 使用包变量的配置恢复文件的历史版本，见Client.RestoreVersion
+func RestoreVersion(fn string, id int) error {
+	return defaultClient().RestoreVersion(fn, id)
+}
+
+// RestoreVersion 把服务端文件的历史版本恢复为当前版本
+func (c *Client) RestoreVersion(fn string, id int) error {
+	conn, err := c.connLogin()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("restore %s %d", fn, id))); err != nil {
+		return err
+	}
+	buf, n, err := c.readBufferTimeOut(conn)
+	if err != nil {
+		return err
+	}
+	res := strings.TrimSpace(string(buf[:n]))
+	if res == "badpath" {
+		return ErrBadPath
+	}
+	if res != "success" {
+		return fmt.Errorf("恢复版本失败: %s", res)
+	}
+	return nil
+}
+
+// DownloadVersion 使用包变量的配置下载文件的指定版本，见Client.DownloadVersion
+func DownloadVersion(fn string, id int, dst string) error {
+	return defaultClient().DownloadVersion(fn, id, dst)
+}
+
+// DownloadVersion 下载服务端文件的指定版本，保存到dst
+// 协议：fetch {file_name} {version}
+// 返回：第一行为{file_size} [enc={meta} chunk={chunk_size} plain={size}]，失败时为fail，之后是文件内容
+// 端到端加密的版本使用c.Passphrase和这个版本的加密元数据逐个解密拆分文件，没有设置口令时返回ErrNeedPassphrase
+func (c *Client) DownloadVersion(fn string, id int, dst string) error {
+	conn, err := c.connLogin()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = c.writeBufferTimeOut(conn, []byte(fmt.Sprintf("fetch %s %d", fn, id))); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line == "badpath\n" {
+		return ErrBadPath
+	}
+	head := strings.Fields(line)
+	if len(head) == 0 {
+		return fmt.Errorf("下载版本失败: %s", strings.TrimSpace(line))
+	}
+	size, err := strconv.ParseInt(head[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("下载版本失败: %s", strings.TrimSpace(line))
+	}
+	opts, err := analyzeOpts(head[1:])
+	if err != nil {
+		return err
+	}
+	var meta *cipherMeta
+	var aead cipher.AEAD
+	var ssize, plain int64
+	if opts["enc"] != "" {
+		if c.Passphrase == "" {
+			c.logf("服务端文件使用端到端加密, 没有设置口令, fn:%s\n", fn)
+			return ErrNeedPassphrase
+		}
+		if meta, err = parseCipherMeta(opts["enc"]); err != nil {
+			return err
+		}
+		if ssize, err = strconv.ParseInt(opts["chunk"], 10, 64); err != nil {
+			return fmt.Errorf("protocol error")
+		}
+		if plain, err = strconv.ParseInt(opts["plain"], 10, 64); err != nil {
+			return fmt.Errorf("protocol error")
+		}
+		if aead, err = meta.aead(c.Passphrase); err != nil {
+			c.logf("端到端加密口令错误, fn:%s\n", fn)
+			return err
+		}
+	}
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if aead != nil {
+		return decryptChunks(fp, io.LimitReader(br, size), meta, aead, ssize, plain)
+	}
+	if _, err = io.CopyN(fp, br, size); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package client
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// listXattrs 读取文件的所有扩展属性
+func listXattrs(fn string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(fn, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(fn, buf); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := syscall.Getxattr(fn, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(fn, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package client
+
+// listXattrs 非linux系统不读取扩展属性
+func listXattrs(fn string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditFile 审计日志文件，记录删除等修改已上传文件的操作，为空时只写入服务日志
+var AuditFile = ""
+
+// auditMu 保证多个协程写入的审计记录不会交错
+var auditMu sync.Mutex
+
+// audit 记录一条审计日志
+// 格式：time={RFC3339} op={op} user={user} name={quoted_name} [{detail}]
+// user为-时表示服务端自动执行的操作
+func audit(op, usr, name, detail string) {
+	line := fmt.Sprintf("time=%s op=%s user=%s name=%s", time.Now().Format(time.RFC3339), op, usr, strconv.Quote(name))
+	if detail != "" {
+		line += " " + detail
+	}
+	log.Printf("审计, %s\n", line)
+	if AuditFile == "" {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	fp, err := os.OpenFile(AuditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("打开审计日志失败, fn:%s, err:%s\n", AuditFile, err)
+		return
+	}
+	defer fp.Close()
+	if _, err = fp.WriteString(line + "\n"); err != nil {
+		log.Printf("写入审计日志失败, fn:%s, err:%s\n", AuditFile, err)
+	}
+}
@@ -1,50 +1,105 @@
 package server
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
-	"strings"
+	"path"
 	"sync"
+	"time"
 )
 
 const singleMaxSize = int64(1024)
 
 type fileServer struct {
-	usr   *user               // 用户
-	uid   string              // 唯一id
-	conn  net.Conn            // 连接
-	size  int64               // 文件大小
-	num   int                 // 文件个数
-	fn    string              // 文件名
-	split []*singleFileServer // 单个拆分文件处理服务
-	mu    sync.Mutex
+	usr      *user               // 用户
+	uid      string              // 上传会话id
+	conn     net.Conn            // 连接
+	size     int64               // 文件大小
+	num      int                 // 文件个数
+	fn       string              // 文件名
+	compress string              // 协商的拆分文件压缩算法
+	enc      string              // 客户端端到端加密元数据，为空时不加密
+	overhead int64               // 加密后每个拆分文件增加的字节数
+	dk       *dataKey            // 静态加密的数据密钥，不加密时为nil
+	conflict string              // 与已存在的同名文件冲突时的处理策略
+	sum      string              // 客户端文件的sha256，用于skip策略比较文件内容
+	meta     *FileMeta           // 客户端源文件的元数据，为nil时不设置
+	source   string              // 会话记录中客户端源文件的指纹，为空时不检查源文件变化
+	changed  string              // 续传时源文件变化后的新指纹，客户端校验拆分文件后替换source
+	holes    []extent            // 客户端文件的空洞，不接受空洞时为nil
+	holeIdx  map[int]bool        // 全部在空洞中的拆分文件序号
+	orig     string              // 客户端请求的文件名，rename策略提交时重新选择文件名使用
+	renamed  bool                // 是否因为冲突重命名了文件
+	expired  bool                // 客户端续传的会话已被过期清理，新建了会话
+	expire   time.Time           // 上传会话的过期时间，空闲超过SessionTTL后临时数据被删除
+	split    []*singleFileServer // 单个拆分文件处理服务
+	mu       sync.Mutex
 }
 
 // receive 接收大文件
 func (fs *fileServer) receive() {
-	// 生成唯一id
-	fs.genID()
-	// 存储fs
-	ok := allfsAdd(fs)
+	fn, err := userPath(fs.usr, fs.fn)
+	if err != nil {
+		log.Printf("文件名不合法, usr:%s, fn:%s\n", fs.usr.name, fs.fn)
+		writeBufferTimeOut(fs.conn, []byte("badpath\n"))
+		return
+	}
+	fs.fn = fn
+	// 客户端指定会话id时恢复会话，否则处理同名文件冲突后创建新的会话
+	if fs.uid == "" || !fs.resume(fs.uid) {
+		fs.expired = fs.uid != "" && sessionExpired(fs.uid)
+		fs.orig = fs.fn
+		res, err := fs.resolveConflict()
+		if err != nil {
+			log.Printf("处理文件冲突错误, fn:%s, err:%s\n", fs.fn, err)
+			return
+		}
+		if res != "" {
+			writeBufferTimeOut(fs.conn, []byte(res))
+			return
+		}
+		if fs.uid, err = newSessionID(); err != nil {
+			log.Printf("生成会话id错误, fn:%s, err:%s\n", fs.fn, err)
+			return
+		}
+	}
+	// 计算文件拆分方案
+	fs.calSplitNum()
+	// 检查并预留存储空间
+	if err = fs.reserve(true); err != nil {
+		log.Printf("预留存储空间失败, uid:%s, err:%s\n", fs.uid, err)
+		if err == errNoSpace {
+			writeBufferTimeOut(fs.conn, []byte("nospace"))
+		}
+		return
+	}
+	// 存储fs，替换服务端重启后恢复的没有主连接的会话
+	ok := allfsAttach(fs)
 	defer fs.stopAll()
-	// 防止用户多处登陆并发上传
+	// 同一个会话只能有一个主连接
 	if !ok {
 		log.Printf("建立文件上传服务失败,uid:%s\n", fs.uid)
 		return
 	}
-	// 创建文件夹
-	if err := os.MkdirAll(fs.dirName(), 0777); err != nil {
-		log.Printf("新建文件夹错误, err:%s\n", err)
+	// 创建临时存储，恢复续传需要的元数据，与清理过期会话互斥
+	unlock := lockName(fs.uid)
+	err = fs.prepareTemp()
+	if err == nil {
+		err = fs.saveSession()
+	}
+	if err == nil {
+		err = fs.touch()
+	}
+	unlock()
+	if err != nil {
+		log.Printf("新建临时存储错误, uid:%s, err:%s\n", fs.uid, err)
+		release(fs.uid)
 		return
 	}
-	// 计算文件拆分方案
-	fs.calSplitNum()
 	// 回复客户端文件拆分方案
-	err := fs.sendSplit()
+	err = fs.sendSplit()
 	if err != nil {
 		return
 	}
@@ -52,26 +107,60 @@ func (fs *fileServer) receive() {
 	fs.listenOp()
 }
 
-// genId 生成这次上传的唯一id:远程地址_文件名
-func (fs *fileServer) genID() {
-	fs.uid = fmt.Sprintf("%s_%s", fs.usr.name, fs.fn)
-	fs.fn = strings.TrimPrefix(fs.fn, "/")
-	// 文件名为：./upload/{uid}/{file.name}
-	fs.fn = fmt.Sprintf("./upload/%s/%s", fs.usr.name, fs.fn)
+// upload 返回这次上传在存储中的拆分方案，端到端加密时为密文的大小
+func (fs *fileServer) upload() *Upload {
+	return &Upload{
+		ID:    fs.uid,
+		Name:  fs.fn,
+		Size:  fs.size + int64(fs.num)*fs.overhead,
+		Chunk: singleMaxSize + fs.overhead,
+		Num:   fs.num,
+		Holes: fs.holeIdx,
+	}
 }
 
-// dirName 返回文件的临时文件夹名称
-func (fs *fileServer) dirName() string {
-	return fs.fn + "_temp"
+// prepareTemp 创建临时存储，恢复续传需要的加密元数据和数据密钥
+// 与这次上传不一致时，之前上传的拆分文件不能再使用，清空后重新上传
+func (fs *fileServer) prepareTemp() error {
+	if err := Store.Prepare(fs.upload()); err != nil {
+		return err
+	}
+	// 源文件变化后清空的拆分文件会用同样的nonce或者密钥流加密新的内容，加密时不保留已上传的拆分文件
+	if fs.changed != "" && (fs.enc != "" || masterKey != nil) {
+		log.Printf("源文件已变化，使用新的密钥重新上传, uid:%s, fn:%s\n", fs.uid, fs.fn)
+		fs.changed = ""
+		return fs.resetTemp()
+	}
+	encOK, err := fs.loadEnc()
+	if err != nil {
+		return err
+	}
+	keyOK, err := fs.loadKey()
+	if err != nil {
+		return err
+	}
+	if encOK && keyOK {
+		return nil
+	}
+	return fs.resetTemp()
 }
 
-// singlefilename 获取拆分文件文件名
-func (fs *fileServer) singlefilename(index int) string {
-	// 文件名为：./upload/{uid}/{file.name}_temp/{idx}
-	return fmt.Sprintf("%s/%d", fs.dirName(), index)
+// resetTemp 清空临时存储，保存这次上传的加密元数据并生成新的数据密钥
+func (fs *fileServer) resetTemp() error {
+	log.Printf("清空临时存储, uid:%s, fn:%s\n", fs.uid, fs.fn)
+	if err := Store.Abort(fs.uid); err != nil {
+		return err
+	}
+	if err := Store.Prepare(fs.upload()); err != nil {
+		return err
+	}
+	if err := fs.saveEnc(); err != nil {
+		return err
+	}
+	return fs.saveKey()
 }
 
-// calSplitNum 计算文件应该拆分的个数
+// calSplitNum 计算文件应该拆分的个数，并标记全部在空洞中的拆分文件
 // 规定每个文件的最大大小进行拆分
 func (fs *fileServer) calSplitNum() {
 	num := fs.size / singleMaxSize
@@ -80,11 +169,38 @@ func (fs *fileServer) calSplitNum() {
 	}
 	fs.num = int(num)
 	fs.split = make([]*singleFileServer, num)
+	fs.markHoles()
 }
 
 // splitFile 回复客户端文件拆分方案
+// 协议：{file_size} {unique_id} [compress={name}] [enc={meta} overhead={n}] [name={file.name}] [expire={unix}] [expired=1] [sparse=1] [changed=1]
+// sparse=1表示接受客户端的空洞，全部在空洞中的拆分文件不需要上传
+// changed=1表示续传时源文件已经变化，客户端需要校验已上传的拆分文件
+// expired=1表示客户端续传的会话已被过期清理，unique_id是新的会话，需要重新上传整个文件
+// 冲突重命名时name返回重命名后的文件名，expire为会话空闲时临时数据被删除的时间
 func (fs *fileServer) sendSplit() error {
 	res := fmt.Sprintf("%d %s", singleMaxSize, fs.uid)
+	if !fs.expire.IsZero() {
+		res += fmt.Sprintf(" expire=%d", fs.expire.Unix())
+	}
+	if fs.expired {
+		res += " expired=1"
+	}
+	if fs.renamed {
+		res += " name=" + path.Base(fs.fn)
+	}
+	if fs.compress != noCompress {
+		res += " compress=" + fs.compress
+	}
+	if fs.enc != "" {
+		res += fmt.Sprintf(" enc=%s overhead=%d", fs.enc, fs.overhead)
+	}
+	if len(fs.holeIdx) > 0 {
+		res += " sparse=1"
+	}
+	if fs.changed != "" {
+		res += " changed=1"
+	}
 	err := writeBufferTimeOut(fs.conn, []byte(res))
 	if err != nil {
 		log.Printf("发送文件拆分方案到客户端失败, uid:%s, err:%s\n", fs.uid, err)
@@ -108,7 +224,7 @@ func (fs *fileServer) listenOp() {
 			continue
 		}
 		op := string(buffer[:n])
-		opType, uid, _, err := analyzeOp(op)
+		opType, uid, _, opts, err := analyzeOp(op)
 		if err != nil {
 			errTime++
 			continue
@@ -120,17 +236,23 @@ func (fs *fileServer) listenOp() {
 				errTime++
 				continue
 			}
-			ok := fs.end()
-			if ok {
-				// 组装文件
-				if fs.assembFile() {
-					writeBufferTimeOut(fs.conn, []byte("success"))
-				} else {
-					writeBufferTimeOut(fs.conn, []byte("assemb fail"))
-				}
-			} else {
-				writeBufferTimeOut(fs.conn, []byte("fail"))
+			writeBufferTimeOut(fs.conn, []byte(fs.finish()))
+			break
+		case statusType:
+			if uid != fs.uid {
+				log.Printf("查询状态uid错误, fs.uid:%s, uid:%s\n", fs.uid, uid)
+				errTime++
+				continue
+			}
+			fs.sendStatus(fs.conn, opts["hash"] == "1")
+			break
+		case resetType:
+			if uid != fs.uid {
+				log.Printf("清空拆分文件uid错误, fs.uid:%s, uid:%s\n", fs.uid, uid)
+				errTime++
+				continue
 			}
+			writeBufferTimeOut(fs.conn, []byte(fs.reset(opts["idx"], opts["done"] == "1")))
 			break
 		default:
 			log.Printf("操作类型错误, %d\n", opType)
@@ -140,15 +262,38 @@ func (fs *fileServer) listenOp() {
 	}
 }
 
+// finish 结束上传，所有拆分文件上传成功时组装文件，返回回复客户端的结果
+// 提交时重新选择了文件名时返回success name={file.name}
+func (fs *fileServer) finish() string {
+	// 源文件变化后客户端还没有校验拆分文件，组装会混合新旧内容
+	if fs.changed != "" {
+		log.Printf("源文件变化后没有校验拆分文件，拒绝组装, uid:%s\n", fs.uid)
+		return "fail"
+	}
+	if !fs.end() {
+		return "fail"
+	}
+	// 组装文件
+	fn := fs.fn
+	if !fs.assembFile() {
+		return "assemb fail"
+	}
+	// 提交时重新选择了文件名
+	if fs.fn != fn {
+		return "success name=" + path.Base(fs.fn)
+	}
+	return "success"
+}
+
 // add 添加single file server
 func (fs *fileServer) add(sfs *singleFileServer) bool {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	if fs.split[sfs.idx] != nil {
+	// 超出拆分文件数量
+	if sfs.idx < 0 || len(fs.split) <= sfs.idx {
 		return false
 	}
-	// 超出拆分文件数量
-	if len(fs.split) <= sfs.idx {
+	if fs.split[sfs.idx] != nil {
 		return false
 	}
 	fs.split[sfs.idx] = sfs
@@ -159,7 +304,7 @@ func (fs *fileServer) add(sfs *singleFileServer) bool {
 func (fs *fileServer) stopAll() {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	allfsDelete(fs.uid)
+	allfsDelete(fs)
 	for _, sfs := range fs.split {
 		if sfs == nil {
 			continue
@@ -176,6 +321,7 @@ func (fs *fileServer) end() bool {
 		sfs := fs.split[i]
 		if sfs != nil {
 			sfs.stop()
+			sfs.wait(time.Second * 10)
 			fs.split[i] = nil
 		}
 	}
@@ -185,54 +331,69 @@ func (fs *fileServer) end() bool {
 // checkSuc 检查是否所有拆分文件上传成功
 func (fs *fileServer) checkSuc() bool {
 	// 校验是否所有文件上传结束
+	u := fs.upload()
 	var sum int64
 	for i := 0; i < fs.num; i++ {
-		size, err := getFileSize(fs.singlefilename(i))
+		if u.Holes[i] {
+			sum += u.chunkSize(i)
+			continue
+		}
+		size, err := Store.Offset(u, i)
 		if err != nil {
 			continue
 		}
 		sum += size
 	}
-	return sum == fs.size
+	return sum == u.Size
 }
 
-// assembFile 组装拆分的文件
-// 不需要加锁，因为一个文件只会有一个fileServer
-func (fs *fileServer) assembFile() bool {
-	var fp *os.File
-	res, err := os.OpenFile(fs.fn, os.O_CREATE|os.O_WRONLY, 0766)
-	if err != nil {
-		log.Printf("组装文件错误, uid:%s\n", fs.uid)
-		return false
-	}
-	defer res.Close()
-	bw := bufio.NewWriter(res)
-	buf := make([]byte, 1024)
-	for i := 0; i < fs.num; i++ {
-		fp, err = os.OpenFile(fs.singlefilename(i), os.O_RDONLY, 0766)
-		if err != nil {
-			log.Printf("组装文件错误, uid:%s\n", fs.uid)
-			return false
+// saveSidecars 保存组装的文件staged的加密元数据、数据密钥和上传时间，返回保存的元数据文件后缀
+func (fs *fileServer) saveSidecars(staged string) ([]string, error) {
+	var exts []string
+	if fs.enc != "" {
+		if err := fs.saveEncMeta(staged); err != nil {
+			return nil, fmt.Errorf("保存加密元数据错误: %s", err)
 		}
-		defer fp.Close()
-		br := bufio.NewReader(fp)
-		for {
-			n, err := br.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return false
-			}
-			bw.Write(buf[:n])
+		exts = append(exts, ".enc")
+	}
+	if fs.dk != nil {
+		if err := fs.saveKeyMeta(staged); err != nil {
+			return nil, fmt.Errorf("保存数据密钥错误: %s", err)
 		}
-		if err := bw.Flush(); err != nil {
+		exts = append(exts, ".key")
+	}
+	if err := saveUploaded(staged); err != nil {
+		return nil, fmt.Errorf("保存上传时间错误: %s", err)
+	}
+	return append(exts, uploadedExt), nil
+}
+
+// assembFile 组装拆分的文件
+// 先组装到同目录下的隐藏文件，组装期间当前版本仍然可以读取，再按文件名加锁提交为当前版本，见commitFile
+// 多个会话同时上传同一个文件时，提交按完成的顺序进行，最后完成的会话的内容为当前版本
+func (fs *fileServer) assembFile() bool {
+	// 上传过程中其他会话生成了同名文件，拆分文件保留
+	if fs.conflict == conflictReject {
+		if _, err := Store.Stat(fs.fn); err == nil {
+			log.Printf("文件已存在，拒绝组装, uid:%s, fn:%s\n", fs.uid, fs.fn)
 			return false
 		}
 	}
-	// 合并成功后，删除文件夹和拆分的临时文件
-	if err = os.RemoveAll(fs.dirName()); err != nil {
-		log.Printf("删除文件错误, file name=%s\n", fs.fn+"_temp")
+	staged := stageName(fs.fn, fs.uid)
+	u := fs.upload()
+	u.Name = staged
+	if err := Store.Assemble(u); err != nil {
+		log.Printf("组装文件错误, uid:%s, err:%s\n", fs.uid, err)
+		return false
+	}
+	// 组装完成后临时数据已删除
+	release(fs.uid)
+	if err := fs.commitFile(staged); err != nil {
+		log.Printf("提交文件错误, uid:%s, fn:%s, err:%s\n", fs.uid, fs.fn, err)
+		if err = removeFile(staged); err != nil {
+			log.Printf("删除组装的文件错误, fn:%s, err:%s\n", staged, err)
+		}
+		return false
 	}
 	return true
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 组装的文件通过提交记录替换为当前版本：
+// 1. 拆分文件组装到同目录下的隐藏文件{dir}/.{uid}.tmp，元数据文件保存在.meta/.{uid}.tmp{ext}，组装期间当前版本仍然可以读取
+// 2. 锁定文件名后保存提交记录.meta/{file.name}.commit，保存成功后提交不会再失败
+// 3. 按提交记录归档当前版本、替换元数据文件、把组装的文件重命名为最终文件并记录新的版本，最后删除提交记录
+// 第3步中服务端崩溃或者存储出错时，下一次锁定文件名（lockFile）按提交记录继续完成，不会留下只替换了一部分的文件
+
+// commitExt 提交记录的后缀，保存在元数据文件目录中
+const commitExt = ".commit"
+
+// stageName 返回上传会话组装的隐藏文件：{dir}/.{uid}.tmp
+func stageName(name, uid string) string {
+	return path.Join(path.Dir(name), "."+uid+".tmp")
+}
+
+// pending 提交记录
+type pending struct {
+	staged  string   // 组装的隐藏文件在同一目录中的名称
+	session string   // 上传会话id，记录在新的版本中
+	size    int64    // 文件大小
+	archive int      // 归档当前版本使用的版本号，为0时不归档
+	exts    []string // 组装的文件的元数据文件后缀，最终文件的其他元数据文件被删除
+}
+
+// String 返回提交记录的格式：staged={name} session={uid} size={size} archive={id} exts={ext},...
+func (p *pending) String() string {
+	return fmt.Sprintf("staged=%s session=%s size=%d archive=%d exts=%s", p.staged, p.session, p.size, p.archive, strings.Join(p.exts, ","))
+}
+
+// parsePending 解析提交记录
+func parsePending(rec string) (*pending, error) {
+	opts, err := analyzeOpts(strings.Fields(rec))
+	if err != nil {
+		return nil, err
+	}
+	p := &pending{staged: opts["staged"], session: opts["session"]}
+	if p.size, err = strconv.ParseInt(opts["size"], 10, 64); err != nil {
+		return nil, err
+	}
+	if p.archive, err = strconv.Atoi(opts["archive"]); err != nil {
+		return nil, err
+	}
+	if opts["exts"] != "" {
+		p.exts = strings.Split(opts["exts"], ",")
+	}
+	if p.staged == "" || strings.Contains(p.staged, "/") {
+		return nil, fmt.Errorf("commit record error: %s", rec)
+	}
+	return p, nil
+}
+
+// hasExt 元数据文件后缀是否在exts中
+func (p *pending) hasExt(ext string) bool {
+	for _, e := range p.exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// lockFile 锁定文件名，并完成之前没有完成的提交，返回解锁函数
+// 提交仍然不能完成时解锁并返回错误，这时文件可能只替换了一部分，不能读取
+func lockFile(name string) (func(), error) {
+	unlock := lockName(name)
+	if err := recoverCommit(name); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// recoverCommit 按提交记录完成之前没有完成的提交，调用方需要锁定文件名
+func recoverCommit(name string) error {
+	b, err := Store.ReadFile(metaName(name, commitExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	p, err := parsePending(string(b))
+	if err != nil {
+		return err
+	}
+	log.Printf("继续完成文件提交, name:%s, session:%s\n", name, p.session)
+	return finishCommit(name, p)
+}
+
+// commitFile 把组装的文件staged提交为当前版本，reject策略下文件已经存在时返回errExists
+// 保存提交记录之前失败时返回错误，调用方删除组装的文件；之后的错误在下一次锁定文件名时重试
+func (fs *fileServer) commitFile(staged string) error {
+	exts, err := fs.saveSidecars(staged)
+	if err != nil {
+		return err
+	}
+	fs.applyMeta(staged)
+	unlock, err := fs.lockTarget()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// 组装过程中其他会话生成了同名文件
+	if fs.conflict == conflictReject {
+		if _, err = Store.Stat(fs.fn); err == nil {
+			return errExists
+		}
+	}
+	p := &pending{staged: path.Base(staged), session: fs.uid, size: fs.size, exts: exts}
+	if p.archive, err = archiveID(fs.fn); err != nil {
+		return fmt.Errorf("查询历史版本错误: %s", err)
+	}
+	if err = Store.WriteFile(metaName(fs.fn, commitExt), []byte(p.String())); err != nil {
+		return fmt.Errorf("保存提交记录错误: %s", err)
+	}
+	if err = finishCommit(fs.fn, p); err != nil {
+		log.Printf("完成文件提交错误，下一次访问文件时重试, uid:%s, fn:%s, err:%s\n", fs.uid, fs.fn, err)
+	}
+	return nil
+}
+
+// archiveID 返回提交时归档当前版本使用的版本号，不保留历史版本或者当前版本不存在时为0
+// 开启版本管理之前上传的文件先记录为版本1
+func archiveID(name string) (int, error) {
+	if !versioning() {
+		return 0, nil
+	}
+	info, err := Store.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	vers, err := loadVersions(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(vers) == 0 {
+		vers = append(vers, &version{id: 1, time: info.ModTime, session: "-", size: info.Size})
+		if err = saveVersions(name, vers); err != nil {
+			return 0, err
+		}
+	}
+	return vers[len(vers)-1].id, nil
+}
+
+// finishCommit 按提交记录完成提交，每一步都可以重复执行，调用方需要锁定文件名
+func finishCommit(name string, p *pending) error {
+	staged := path.Join(path.Dir(name), p.staged)
+	// 组装的文件还没有重命名并且当前版本还没有归档时归档当前版本
+	if p.archive > 0 {
+		_, err := Store.Stat(staged)
+		if err == nil {
+			_, err = Store.Stat(name)
+		}
+		if err == nil {
+			if err = moveFile(name, versionName(name, p.archive)); err != nil {
+				return fmt.Errorf("归档历史版本错误: %s", err)
+			}
+			log.Printf("归档历史版本, name:%s, id:%d\n", name, p.archive)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// 替换元数据文件，组装的文件没有的元数据文件删除
+	for _, ext := range sidecars {
+		var err error
+		if p.hasExt(ext) {
+			err = Store.Rename(metaName(staged, ext), metaName(name, ext))
+		} else {
+			err = Store.Remove(metaName(name, ext))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("替换元数据文件错误: %s", err)
+		}
+	}
+	if err := Store.Rename(staged, name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("替换文件错误: %s", err)
+	}
+	vers, err := loadVersions(name)
+	if err != nil {
+		return err
+	}
+	if len(vers) == 0 || vers[len(vers)-1].session != p.session {
+		if err = addVersion(name, vers, p.session, p.size); err != nil {
+			return fmt.Errorf("保存版本记录错误: %s", err)
+		}
+	}
+	return Store.Remove(metaName(name, commitExt))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// noCompress 不压缩
+const noCompress = "none"
+
+// Decompressor 根据压缩数据流创建解压缩流
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decompMu sync.RWMutex
+	// 支持的解压缩算法, key=算法名称
+	decompressors = map[string]Decompressor{
+		"gzip": func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		"deflate": func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+)
+
+// RegisterDecompressor 注册解压缩算法，同名算法会被覆盖
+func RegisterDecompressor(name string, d Decompressor) {
+	decompMu.Lock()
+	defer decompMu.Unlock()
+	decompressors[name] = d
+}
+
+// getDecompressor 获取解压缩算法
+func getDecompressor(name string) (Decompressor, bool) {
+	decompMu.RLock()
+	defer decompMu.RUnlock()
+	d, ok := decompressors[name]
+	return d, ok
+}
+
+// chooseCompress 从客户端提供的算法列表(逗号分隔，按优先级排序)中选择服务端支持的第一个
+func chooseCompress(offer string) string {
+	if offer == "" {
+		return noCompress
+	}
+	for _, name := range strings.Split(offer, ",") {
+		if _, ok := getDecompressor(name); ok {
+			return name
+		}
+	}
+	return noCompress
+}
+
+// decompressReader 返回拆分文件数据的读取流，不压缩时直接从连接读取
+func decompressReader(name string, r io.Reader) (io.ReadCloser, error) {
+	if name == "" || name == noCompress {
+		return io.NopCloser(r), nil
+	}
+	d, ok := getDecompressor(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown compress %s", name)
+	}
+	return d(r)
+}
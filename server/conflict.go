@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// 上传文件与已存在的同名文件冲突时的处理策略
+const (
+	conflictOverwrite = "overwrite" // 覆盖已存在的文件
+	conflictRename    = "rename"    // 保留两个文件，新文件自动重命名为{name}({n}){ext}
+	conflictSkip      = "skip"      // 大小和sha256都相同时跳过上传，否则覆盖
+	conflictReject    = "reject"    // 拒绝上传
+)
+
+// ConflictPolicy 客户端没有指定冲突策略时使用的默认策略
+var ConflictPolicy = conflictOverwrite
+
+// validConflict 冲突策略是否正确
+func validConflict(policy string) bool {
+	switch policy {
+	case conflictOverwrite, conflictRename, conflictSkip, conflictReject:
+		return true
+	}
+	return false
+}
+
+// resolveConflict 按冲突策略处理已存在的同名文件，在接收拆分文件之前调用
+// 返回非空字符串时不再上传，作为结果回复客户端：exists表示拒绝上传，identical表示内容相同已跳过
+// rename策略时fs.fn修改为不冲突的文件名
+func (fs *fileServer) resolveConflict() (string, error) {
+	if fs.conflict == conflictOverwrite {
+		return "", nil
+	}
+	unlock, err := lockFile(fs.fn)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	info, err := Store.Stat(fs.fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	switch fs.conflict {
+	case conflictReject:
+		log.Printf("文件已存在，拒绝上传, fn:%s\n", fs.fn)
+		return "exists", nil
+	case conflictSkip:
+		same, err := fs.identical(info)
+		if err != nil {
+			return "", err
+		}
+		if same {
+			log.Printf("文件内容相同，跳过上传, fn:%s\n", fs.fn)
+			return "identical", nil
+		}
+	case conflictRename:
+		fn, err := freeName(fs.fn)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("文件已存在，重命名上传, fn:%s, rename:%s\n", fs.fn, fn)
+		fs.fn = fn
+		fs.renamed = true
+	}
+	return "", nil
+}
+
+// lockTarget 锁定提交的文件名，返回解锁函数
+// rename策略下组装期间其他会话生成了同名文件时，按客户端请求的文件名重新选择不冲突的文件名
+// 同时上传同一个文件的会话在接收拆分文件之前可能选择了相同的文件名，只有锁定后检查才不会互相覆盖
+func (fs *fileServer) lockTarget() (func(), error) {
+	for {
+		unlock, err := lockFile(fs.fn)
+		if err != nil || fs.conflict != conflictRename {
+			return unlock, err
+		}
+		if _, err = Store.Stat(fs.fn); err != nil {
+			if os.IsNotExist(err) {
+				return unlock, nil
+			}
+			unlock()
+			return nil, err
+		}
+		unlock()
+		fn, err := freeName(fs.orig)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("文件已被其他会话生成，重命名提交, fn:%s, rename:%s\n", fs.fn, fn)
+		fs.fn = fn
+		fs.renamed = true
+	}
+}
+
+// identical 比较已存在的文件与客户端文件的大小和sha256
+// 端到端加密的文件服务端没有明文，总是认为不相同
+func (fs *fileServer) identical(info *FileInfo) (bool, error) {
+	if fs.sum == "" || info.Size != fs.size {
+		return false, nil
+	}
+	if _, err := Store.Stat(metaName(fs.fn, ".enc")); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	rc, err := openFile(fs.fn)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, rc); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(fs.sum), nil
+}
+
+// freeName 返回不存在的文件名：{name}({n}){ext}
+func freeName(name string) (string, error) {
+	ext := path.Ext(name)
+	if ext == path.Base(name) {
+		// .开头的隐藏文件没有扩展名
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		fn := fmt.Sprintf("%s(%d)%s", base, i, ext)
+		if _, err := Store.Stat(fn); err != nil {
+			if os.IsNotExist(err) {
+				return fn, nil
+			}
+			return "", err
+		}
+	}
+}
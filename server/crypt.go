@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeyFile 静态加密主密钥文件，内容为32字节密钥的hex编码
+// 为空时文件以明文存储
+var KeyFile = ""
+
+// masterKey 静态加密主密钥，用来加密每个文件的数据密钥
+var masterKey []byte
+
+// loadMasterKey 从KeyFile加载主密钥
+func loadMasterKey() error {
+	b, err := os.ReadFile(KeyFile)
+	if err != nil {
+		return err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+// dataKey 文件的数据密钥
+// 使用AES-CTR加密，密钥流由文件内的偏移决定，因此拆分文件可以独立加密、按偏移续传，组装时直接拼接
+type dataKey struct {
+	key []byte // 数据密钥
+	iv  []byte // 初始计数器
+}
+
+// newDataKey 生成新的数据密钥
+func newDataKey() (*dataKey, error) {
+	dk := &dataKey{key: make([]byte, 32), iv: make([]byte, aes.BlockSize)}
+	if _, err := rand.Read(dk.key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(dk.iv); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// masterAEAD 返回主密钥的加密算法
+func masterAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap 用主密钥加密数据密钥
+// 格式：key={wrapped_key} nonce={nonce} iv={iv}
+func (dk *dataKey) wrap() (string, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := aead.Seal(nil, nonce, dk.key, dk.iv)
+	return fmt.Sprintf("key=%x nonce=%x iv=%x", wrapped, nonce, dk.iv), nil
+}
+
+// unwrapDataKey 用主密钥解密数据密钥
+func unwrapDataKey(s string) (*dataKey, error) {
+	opts, err := analyzeOpts(strings.Fields(s))
+	if err != nil {
+		return nil, err
+	}
+	var wrapped, nonce []byte
+	dk := &dataKey{}
+	if wrapped, err = hex.DecodeString(opts["key"]); err != nil {
+		return nil, err
+	}
+	if nonce, err = hex.DecodeString(opts["nonce"]); err != nil {
+		return nil, err
+	}
+	if dk.iv, err = hex.DecodeString(opts["iv"]); err != nil {
+		return nil, err
+	}
+	aead, err := masterAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() || len(dk.iv) != aes.BlockSize {
+		return nil, fmt.Errorf("wrapped key error")
+	}
+	if dk.key, err = aead.Open(nil, nonce, wrapped, dk.iv); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// stream 返回从文件偏移off开始的密钥流
+func (dk *dataKey) stream(off int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(dk.key)
+	if err != nil {
+		return nil, err
+	}
+	// 计数器加上偏移所在的块数
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, dk.iv)
+	ctr := binary.BigEndian.Uint64(iv[8:])
+	blocks := uint64(off / aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], ctr+blocks)
+	if ctr+blocks < ctr {
+		// 低位溢出时向高位进位
+		binary.BigEndian.PutUint64(iv[:8], binary.BigEndian.Uint64(iv[:8])+1)
+	}
+	s := cipher.NewCTR(block, iv)
+	// 跳过偏移在块内的部分
+	skip := make([]byte, off%aes.BlockSize)
+	s.XORKeyStream(skip, skip)
+	return s, nil
+}
+
+// writer 返回从文件偏移off开始加密写入w的数据流
+func (dk *dataKey) writer(w io.Writer, off int64) (io.Writer, error) {
+	s, err := dk.stream(off)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: s, W: w}, nil
+}
+
+// keyName 最终文件的数据密钥文件名
+func keyName(fn string) string {
+	return metaName(fn, ".key")
+}
+
+// tempKeyName 数据密钥在临时存储中的名称
+const tempKeyName = "key"
+
+// loadKey 恢复临时文件夹中保存的数据密钥
+// 返回false表示与当前的静态加密配置不一致，已上传的拆分文件不能再使用
+func (fs *fileServer) loadKey() (bool, error) {
+	b, err := Store.ReadTemp(fs.uid, tempKeyName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return masterKey == nil, nil
+		}
+		return false, err
+	}
+	dk, err := unwrapDataKey(string(b))
+	if err != nil {
+		// 主密钥变化或者密钥文件损坏
+		return false, nil
+	}
+	if masterKey == nil {
+		return false, nil
+	}
+	fs.dk = dk
+	return true, nil
+}
+
+// saveKey 生成数据密钥，加密后保存到临时文件夹
+func (fs *fileServer) saveKey() error {
+	fs.dk = nil
+	if masterKey == nil {
+		return nil
+	}
+	dk, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := dk.wrap()
+	if err != nil {
+		return err
+	}
+	if err = Store.WriteTemp(fs.uid, tempKeyName, []byte(wrapped)); err != nil {
+		return err
+	}
+	fs.dk = dk
+	return nil
+}
+
+// saveKeyMeta 保存文件name的数据密钥
+func (fs *fileServer) saveKeyMeta(name string) error {
+	wrapped, err := fs.dk.wrap()
+	if err != nil {
+		return err
+	}
+	return Store.WriteFile(keyName(name), []byte(wrapped))
+}
+
+// openFile 打开存储中的文件，静态加密的文件读取时透明解密
+func openFile(fn string) (io.ReadCloser, error) {
+	return openFileAt(fn, 0)
+}
+
+// openFileAt 从偏移off开始读取存储中的文件，静态加密的文件读取时透明解密
+func openFileAt(fn string, off int64) (io.ReadCloser, error) {
+	b, err := Store.ReadFile(keyName(fn))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	fp, err := Store.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err = skip(fp, off); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if b == nil {
+		return fp, nil
+	}
+	dk, err := unwrapDataKey(string(b))
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	s, err := dk.stream(off)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{cipherReader(s, fp), fp}, nil
+}
+
+// cipherReader 返回读取时解密的数据流
+func cipherReader(s cipher.Stream, r io.Reader) io.Reader {
+	return cipher.StreamReader{S: s, R: r}
+}
+
+// skip 跳过读取流开头的n个字节，支持Seek时直接移动位置
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
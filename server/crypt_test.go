@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// withMasterKey 使用随机主密钥和内存存储执行测试，结束后恢复
+func withMasterKey(t *testing.T) {
+	t.Helper()
+	oldKey, oldStore := masterKey, Store
+	t.Cleanup(func() { masterKey, Store = oldKey, oldStore })
+	masterKey = make([]byte, 32)
+	rand.Read(masterKey)
+	Store = NewMemStorage()
+}
+
+// sealAt 从偏移off开始加密data
+func sealAt(t *testing.T, dk *dataKey, data []byte, off int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := dk.writer(&buf, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDataKeyStream(t *testing.T) {
+	withMasterKey(t)
+	data := make([]byte, 5000)
+	rand.Read(data)
+	dk, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 计数器低64位接近溢出，偏移所在的块需要向高位进位
+	for _, low := range []byte{0x00, 0xff} {
+		for i := 8; i < 16; i++ {
+			dk.iv[i] = low
+		}
+		dk.iv[15] -= 3
+		full := sealAt(t, dk, data, 0)
+		if bytes.Equal(full, data) {
+			t.Fatalf("data not encrypted")
+		}
+		// 从任意偏移开始的密钥流与从头加密的结果一致
+		for _, off := range []int64{1, 15, 16, 17, 48, 1000, 1023, 4999} {
+			if got := sealAt(t, dk, data[off:], off); !bytes.Equal(got, full[off:]) {
+				t.Fatalf("iv %x: seal at %d mismatch", dk.iv, off)
+			}
+		}
+		// 拆分文件各自加密后直接拼接
+		var joined []byte
+		for off := int64(0); off < int64(len(data)); off += 1024 {
+			end := min(off+1024, int64(len(data)))
+			joined = append(joined, sealAt(t, dk, data[off:end], off)...)
+		}
+		if !bytes.Equal(joined, full) {
+			t.Fatalf("iv %x: joined chunks mismatch", dk.iv)
+		}
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	withMasterKey(t)
+	dk, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := dk.wrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unwrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.key, dk.key) || !bytes.Equal(got.iv, dk.iv) {
+		t.Fatalf("unwrapped key mismatch")
+	}
+	// 其他主密钥不能解密
+	masterKey = make([]byte, 32)
+	if _, err = unwrapDataKey(wrapped); err == nil {
+		t.Fatalf("unwrapped with wrong master key")
+	}
+}
+
+func TestOpenFileAt(t *testing.T) {
+	withMasterKey(t)
+	data := make([]byte, 3000)
+	rand.Read(data)
+	dk, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := dk.wrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Store.WriteFile("u/a.bin", sealAt(t, dk, data, 0))
+	Store.WriteFile(keyName("u/a.bin"), []byte(wrapped))
+	Store.WriteFile("u/plain.bin", data)
+	for _, name := range []string{"u/a.bin", "u/plain.bin"} {
+		for _, off := range []int64{0, 7, 16, 1024, 2999, 3000} {
+			rc, err := openFileAt(name, off)
+			if err != nil {
+				t.Fatalf("%s open at %d: %s", name, off, err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, data[off:]) {
+				t.Fatalf("%s read at %d mismatch, err:%v", name, off, err)
+			}
+		}
+	}
+}
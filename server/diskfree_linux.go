@@ -0,0 +1,14 @@
+//go:build linux
+
+package server
+
+import "syscall"
+
+// diskFree 返回目录所在文件系统非特权用户可用的空间
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
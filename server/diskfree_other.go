@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// diskFree 非linux系统不检查可用空间
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
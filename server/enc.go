@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// encKey 端到端加密元数据在临时存储中的名称，组装完成后保存为.meta/{file.name}.enc
+const encKey = "enc"
+
+// loadEnc 恢复临时文件夹中保存的加密元数据
+// 续传时以保存的元数据为准，保证客户端用同样的密钥和nonce重新加密
+// 返回false表示与这次上传的加密方式不一致，已上传的拆分文件不能再使用
+func (fs *fileServer) loadEnc() (bool, error) {
+	b, err := Store.ReadTemp(fs.uid, encKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fs.enc == "", nil
+		}
+		return false, err
+	}
+	stored, err := analyzeOpts(strings.Fields(string(b)))
+	if err != nil || stored["enc"] == "" || fs.enc == "" {
+		return false, nil
+	}
+	overhead, err := strconv.ParseInt(stored["overhead"], 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	fs.enc, fs.overhead = stored["enc"], overhead
+	return true, nil
+}
+
+// saveEnc 保存加密元数据到临时文件夹
+func (fs *fileServer) saveEnc() error {
+	if fs.enc == "" {
+		return nil
+	}
+	meta := fmt.Sprintf("enc=%s overhead=%d", fs.enc, fs.overhead)
+	return Store.WriteTemp(fs.uid, encKey, []byte(meta))
+}
+
+// saveEncMeta 保存文件name的加密元数据，客户端根据它解密文件
+// 格式：enc={meta} overhead={n} chunk={chunk_size} size={file_size}
+func (fs *fileServer) saveEncMeta(name string) error {
+	meta := fmt.Sprintf("enc=%s overhead=%d chunk=%d size=%d", fs.enc, fs.overhead, singleMaxSize, fs.size)
+	return Store.WriteFile(metaName(name, ".enc"), []byte(meta))
+}
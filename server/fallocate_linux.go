@@ -0,0 +1,21 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate 为文件分配磁盘空间，避免上传过程中磁盘写满
+func fallocate(fp *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(fp.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		// 文件系统不支持时退化为设置文件大小
+		return fp.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// fallocate 设置文件大小，非linux系统不保证分配磁盘空间
+func fallocate(fp *os.File, size int64) error {
+	return fp.Truncate(size)
+}
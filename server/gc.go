@@ -0,0 +1,115 @@
+package server
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// SessionTTL 未完成的上传会话空闲超过这个时间后删除临时数据，为0时不清理（默认）
+	SessionTTL time.Duration = 0
+	// GCInterval 检查过期上传会话的间隔
+	GCInterval = time.Minute * 10
+)
+
+// expireKey 上传会话元数据中保存过期时间的key
+const expireKey = "expire"
+
+var (
+	expiredMu sync.Mutex
+	// expiredIDs 被过期清理的会话id和清理时间，客户端续传这些会话时回复expired
+	// 只保存在内存中，保留SessionTTL后删除，服务端重启后按会话不存在处理
+	expiredIDs = make(map[string]time.Time)
+)
+
+// markExpired 记录被过期清理的会话，同时删除保留超过SessionTTL的记录
+func markExpired(uid string) {
+	expiredMu.Lock()
+	defer expiredMu.Unlock()
+	for id, t := range expiredIDs {
+		if time.Since(t) > SessionTTL {
+			delete(expiredIDs, id)
+		}
+	}
+	expiredIDs[uid] = time.Now()
+}
+
+// sessionExpired 会话是否已经被过期清理
+func sessionExpired(uid string) bool {
+	expiredMu.Lock()
+	defer expiredMu.Unlock()
+	_, ok := expiredIDs[uid]
+	return ok
+}
+
+// sessionFail 返回找不到上传会话时回复客户端的结果，会话已被过期清理时为expired
+func sessionFail(uid string) string {
+	if sessionExpired(uid) {
+		return "expired"
+	}
+	return "fail"
+}
+
+// touch 记录上传会话的过期时间，同时更新临时存储的最后写入时间
+// 之后写入的拆分文件会继续延长过期时间
+func (fs *fileServer) touch() error {
+	if SessionTTL <= 0 {
+		return nil
+	}
+	fs.expire = time.Now().Add(SessionTTL)
+	return Store.WriteTemp(fs.uid, expireKey, []byte(strconv.FormatInt(fs.expire.Unix(), 10)))
+}
+
+// janitor 定时清理过期的上传会话
+func janitor() {
+	for {
+		time.Sleep(GCInterval)
+		collect()
+	}
+}
+
+// collect 删除最后写入时间超过SessionTTL的上传会话的临时数据
+func collect() {
+	temps, err := Store.Temps()
+	if err != nil {
+		log.Printf("查询上传会话失败, err:%s\n", err)
+		return
+	}
+	var num int
+	var size int64
+	for _, temp := range temps {
+		if time.Since(temp.ModTime) < SessionTTL {
+			continue
+		}
+		if reclaim(temp) {
+			num++
+			size += temp.Size
+		}
+	}
+	if num > 0 {
+		log.Printf("清理过期上传会话, 个数:%d, 释放:%d字节\n", num, size)
+	}
+}
+
+// reclaim 删除过期上传会话的临时数据，有主连接或者正在接收拆分文件的会话不会被删除
+func reclaim(temp *FileInfo) bool {
+	unlock := lockName(temp.Name)
+	defer unlock()
+	if fs, ok := allfsGet(temp.Name); ok {
+		// 没有主连接的会话空闲时同样清理
+		if !fs.detached() {
+			return false
+		}
+		allfsDelete(fs)
+	}
+	if err := Store.Abort(temp.Name); err != nil {
+		log.Printf("删除过期上传会话失败, uid:%s, err:%s\n", temp.Name, err)
+		return false
+	}
+	release(temp.Name)
+	markExpired(temp.Name)
+	log.Printf("删除过期上传会话, uid:%s, size:%d, 最后写入:%s\n", temp.Name, temp.Size, temp.ModTime.Format("2006-01-02 15:04:05"))
+	return true
+}
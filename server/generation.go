@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// genDir 副本存储在每个数据目录中记录文件写入代数的目录：{root}/.generations/{name}.gen
+// 文件的修改时间是源文件的修改时间，不能用来判断哪个副本最新，Repair按代数选择最新的副本并同步删除
+const genDir = ".generations"
+
+// generation 文件的写入代数，为服务端写入时的时间（纳秒）
+// deleted为true时是删除记录，Repair删除其他数据目录中代数更小的副本
+type generation struct {
+	gen     int64
+	deleted bool
+}
+
+// newGeneration 返回新的写入代数
+func newGeneration() int64 {
+	return time.Now().UnixNano()
+}
+
+// genName 返回文件的代数记录的文件名
+func genName(ls *LocalStorage, name string) string {
+	return filepath.Join(ls.root, genDir, filepath.FromSlash(name)+".gen")
+}
+
+// stamp 记录文件在数据目录中的写入代数
+// 格式：{gen} [deleted]
+func stamp(ls *LocalStorage, name string, g generation) error {
+	fn := genName(ls, name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	rec := strconv.FormatInt(g.gen, 10)
+	if g.deleted {
+		rec += " deleted"
+	}
+	return os.WriteFile(fn, []byte(rec), 0644)
+}
+
+// unstamp 删除文件在数据目录中的代数记录
+func unstamp(ls *LocalStorage, name string) error {
+	if err := os.Remove(genName(ls, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// moveStamps 目录重命名时移动目录中文件的代数记录
+func moveStamps(ls *LocalStorage, oldName, newName string) error {
+	oldDir := filepath.Join(ls.root, genDir, filepath.FromSlash(oldName))
+	if _, err := os.Stat(oldDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	newDir := filepath.Join(ls.root, genDir, filepath.FromSlash(newName))
+	if err := os.MkdirAll(filepath.Dir(newDir), 0777); err != nil {
+		return err
+	}
+	return os.Rename(oldDir, newDir)
+}
+
+// parseGeneration 解析代数记录
+func parseGeneration(rec string) (generation, error) {
+	arr := strings.Fields(rec)
+	if len(arr) == 0 || len(arr) > 2 || (len(arr) == 2 && arr[1] != "deleted") {
+		return generation{}, fmt.Errorf("generation error: %s", rec)
+	}
+	gen, err := strconv.ParseInt(arr[0], 10, 64)
+	if err != nil {
+		return generation{}, err
+	}
+	return generation{gen: gen, deleted: len(arr) == 2}, nil
+}
+
+// readGeneration 读取文件在数据目录中的代数，没有记录时返回false
+func readGeneration(ls *LocalStorage, name string) (generation, bool) {
+	b, err := os.ReadFile(genName(ls, name))
+	if err != nil {
+		return generation{}, false
+	}
+	g, err := parseGeneration(string(b))
+	if err != nil {
+		return generation{}, false
+	}
+	return g, true
+}
+
+// liveGen 返回文件在数据目录中的写入代数，没有记录或者是删除记录时为0
+func liveGen(ls *LocalStorage, name string) int64 {
+	if g, ok := readGeneration(ls, name); ok && !g.deleted {
+		return g.gen
+	}
+	return 0
+}
+
+// deletedGen 返回文件或者上级目录在数据目录中最大的删除代数，没有删除记录时为0
+func deletedGen(ls *LocalStorage, name string) int64 {
+	var gen int64
+	for p := name; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if g, ok := readGeneration(ls, p); ok && g.deleted {
+			gen = max(gen, g.gen)
+		}
+	}
+	return gen
+}
+
+// loadGenerations 读取数据目录中所有的代数记录，key=相对路径（使用/分隔）
+func loadGenerations(ls *LocalStorage) (map[string]generation, error) {
+	gens := make(map[string]generation)
+	top := filepath.Join(ls.root, genDir)
+	err := filepath.WalkDir(top, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fn == top {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".gen") {
+			return nil
+		}
+		rel, err := filepath.Rel(top, fn)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if g, err := parseGeneration(string(b)); err == nil {
+			gens[filepath.ToSlash(strings.TrimSuffix(rel, ".gen"))] = g
+		}
+		return nil
+	})
+	return gens, err
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// e2eMeta 端到端加密文件的元数据，客户端据此逐个解密拆分块
+type e2eMeta struct {
+	enc      string // 客户端的加密元数据
+	overhead int64  // 每个拆分文件加密后增加的字节数
+	chunk    int64  // 上传时拆分文件的明文大小
+	size     int64  // 明文大小
+}
+
+// loadE2E 读取文件的端到端加密元数据，不是端到端加密的文件返回nil
+func loadE2E(name string) (*e2eMeta, error) {
+	b, err := Store.ReadFile(metaName(name, ".enc"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	opts, err := analyzeOpts(strings.Fields(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	meta := &e2eMeta{enc: opts["enc"]}
+	if meta.overhead, err = strconv.ParseInt(opts["overhead"], 10, 64); err != nil {
+		return nil, err
+	}
+	if meta.chunk, err = strconv.ParseInt(opts["chunk"], 10, 64); err != nil {
+		return nil, err
+	}
+	if meta.size, err = strconv.ParseInt(opts["size"], 10, 64); err != nil {
+		return nil, err
+	}
+	if meta.enc == "" || meta.chunk <= 0 {
+		return nil, fmt.Errorf("enc meta error: %s", b)
+	}
+	return meta, nil
+}
+
+// downloadChunk 返回文件下载时的拆分块大小
+// 端到端加密的文件按上传时的拆分文件拆分，每个拆分块是一个完整的密文，客户端可以逐个解密
+func downloadChunk(name string) (int64, *e2eMeta, error) {
+	meta, err := loadE2E(name)
+	if err != nil || meta == nil {
+		return singleMaxSize, nil, err
+	}
+	return meta.chunk + meta.overhead, meta, nil
+}
+
+// snapshot 下载时读取的文件，文件信息、端到端加密元数据和打开的文件属于同一个版本
+type snapshot struct {
+	info  *FileInfo     // 文件信息
+	chunk int64         // 下载的拆分块大小，见downloadChunk
+	meta  *e2eMeta      // 端到端加密元数据，不是端到端加密的文件为nil
+	rc    io.ReadCloser // 从下载位置开始读取的文件，静态加密的文件读取时解密
+}
+
+// openSnapshot 锁定文件名后读取文件的信息和元数据，并从第idx个拆分块的偏移off打开文件
+// 提交新版本时同时替换文件和元数据文件，加锁保证读取的数据密钥和加密元数据与文件一致；打开后解锁，之后提交的新版本不影响已经打开的文件
+func openSnapshot(name string, idx, off int64) (*snapshot, error) {
+	unlock, err := lockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	snap := &snapshot{}
+	if snap.info, err = Store.Stat(name); err != nil {
+		return nil, err
+	}
+	if snap.chunk, snap.meta, err = downloadChunk(name); err != nil {
+		return nil, fmt.Errorf("读取加密元数据失败: %s", err)
+	}
+	start := idx*snap.chunk + off
+	if idx < 0 || off < 0 || off > snap.chunk || start > snap.info.Size {
+		return nil, fmt.Errorf("下载拆分块超出文件大小, idx:%d, offset:%d, size:%d", idx, off, snap.info.Size)
+	}
+	if snap.rc, err = openFileAt(name, start); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// sendScheme 回复客户端文件的下载方案，发送完成后关闭连接
+// 协议：第一行为{file_size} {chunk_size} mtime={unix_nano} [enc={meta} plain={size}]，之后每个拆分块一行：{chunk_index} {sha256}
+// 文件不存在时回复notfound，失败时回复fail；静态加密的文件按解密后的内容计算
+// 端到端加密的文件携带加密元数据和明文大小，拆分块为上传时加密的拆分文件
+func sendScheme(conn net.Conn, name string) {
+	snap, err := openSnapshot(name, 0, 0)
+	if err != nil {
+		log.Printf("打开下载文件失败, fn:%s, err:%s\n", name, err)
+		if os.IsNotExist(err) {
+			writeBufferTimeOut(conn, []byte("notfound\n"))
+			return
+		}
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return
+	}
+	defer snap.rc.Close()
+	info, meta := snap.info, snap.meta
+	sums, err := chunkSums(snap.rc, info.Size, snap.chunk)
+	if err != nil {
+		log.Printf("计算拆分块sha256失败, fn:%s, err:%s\n", name, err)
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d mtime=%d", info.Size, snap.chunk, info.ModTime.UnixNano())
+	if meta != nil {
+		fmt.Fprintf(&b, " enc=%s plain=%d", meta.enc, meta.size)
+	}
+	b.WriteString("\n")
+	for i, sum := range sums {
+		fmt.Fprintf(&b, "%d %s\n", i, sum)
+	}
+	writeBufferTimeOut(conn, []byte(b.String()))
+}
+
+// chunkSums 按chunk拆分读取的文件，返回每个拆分块的sha256
+func chunkSums(r io.Reader, size, chunk int64) ([]string, error) {
+	var sums []string
+	for off := int64(0); off < size; off += chunk {
+		n := chunk
+		if size-off < n {
+			n = size - off
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, n); err != nil {
+			return nil, err
+		}
+		sums = append(sums, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	return sums, nil
+}
+
+// sendPart 发送文件第idx个拆分块从off开始的数据
+// 协议：先发送一行{n}，失败时为fail，然后发送n个字节
+func sendPart(conn net.Conn, name string, idx, off int64) {
+	snap, err := openSnapshot(name, idx, off)
+	if err != nil {
+		log.Printf("打开下载文件失败, fn:%s, err:%s\n", name, err)
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return
+	}
+	defer snap.rc.Close()
+	start := idx*snap.chunk + off
+	n := min(snap.chunk-off, snap.info.Size-start)
+	if err = writeBufferTimeOut(conn, []byte(fmt.Sprintf("%d\n", n))); err != nil {
+		return
+	}
+	if _, err = io.CopyN(conn, snap.rc, n); err != nil {
+		log.Printf("发送拆分块失败, fn:%s, idx:%d, err:%s\n", name, idx, err)
+	}
+}
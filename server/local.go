@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStorage 本地文件系统存储
+// 最终文件保存在{root}/{name}，拆分文件和会话元数据保存在{root}/.sessions/{id}/中
+type LocalStorage struct {
+	root string // 上传根目录
+}
+
+// NewLocalStorage 创建本地文件系统存储，相对路径按当前工作目录转换为绝对路径
+func NewLocalStorage(root string) *LocalStorage {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	return &LocalStorage{root: root}
+}
+
+// path 返回文件在本地的路径
+func (ls *LocalStorage) path(name string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(name))
+}
+
+// sessionsDir 返回保存所有上传会话的文件夹
+func (ls *LocalStorage) sessionsDir() string {
+	return filepath.Join(ls.root, ".sessions")
+}
+
+// dirName 返回上传会话的临时文件夹：{root}/.sessions/{id}
+func (ls *LocalStorage) dirName(id string) string {
+	return filepath.Join(ls.sessionsDir(), id)
+}
+
+// chunkName 返回拆分文件的文件名：{root}/.sessions/{id}/{idx}
+func (ls *LocalStorage) chunkName(id string, idx int) string {
+	return filepath.Join(ls.dirName(id), strconv.Itoa(idx))
+}
+
+// Prepare 创建临时文件夹
+func (ls *LocalStorage) Prepare(u *Upload) error {
+	return os.MkdirAll(ls.dirName(u.ID), 0777)
+}
+
+// Offset 返回拆分文件的大小
+func (ls *LocalStorage) Offset(u *Upload, idx int) (int64, error) {
+	return getFileSize(ls.chunkName(u.ID, idx))
+}
+
+// Append 打开拆分文件，不存在时创建，存在时追加写
+func (ls *LocalStorage) Append(u *Upload, idx int) (io.WriteCloser, error) {
+	return os.OpenFile(ls.chunkName(u.ID, idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0766)
+}
+
+// ReadChunk 读取拆分文件
+func (ls *LocalStorage) ReadChunk(u *Upload, idx int) (io.ReadCloser, error) {
+	fp, err := os.Open(ls.chunkName(u.ID, idx))
+	if os.IsNotExist(err) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return fp, err
+}
+
+// ResetChunk 删除拆分文件
+func (ls *LocalStorage) ResetChunk(u *Upload, idx int) error {
+	err := os.Remove(ls.chunkName(u.ID, idx))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Assemble 组装拆分的文件
+// 先组装到同目录下的隐藏临时文件，落盘后再重命名为最终文件
+// 读取方只会看到完整的文件，组装失败时不会破坏之前的版本
+// 空洞的拆分文件跳过对应的区域，最终文件是稀疏文件
+func (ls *LocalStorage) Assemble(u *Upload) error {
+	if err := ls.assembleTo(u, ls.path(u.Name)); err != nil {
+		return err
+	}
+	// 合并成功后，删除文件夹和拆分的临时文件
+	if err := ls.Abort(u.ID); err != nil {
+		log.Printf("删除文件错误, file name=%s\n", ls.dirName(u.ID))
+	}
+	return nil
+}
+
+// AssembleOverhead 组装时拆分文件和最终文件同时存在，需要额外一份数据的空间
+func (ls *LocalStorage) AssembleOverhead(u *Upload) int64 {
+	return u.dataSize()
+}
+
+// assembleTo 把拆分文件组装为fn，先写入隐藏的临时文件，落盘后重命名
+func (ls *LocalStorage) assembleTo(u *Upload, fn string) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	res, err := createHidden(fn)
+	if err != nil {
+		return err
+	}
+	defer removeHidden(res)
+	bw := bufio.NewWriter(res)
+	buf := make([]byte, 1024)
+	for i := 0; i < u.Num; i++ {
+		if u.Holes[i] {
+			if _, err = res.Seek(u.chunkSize(i), io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = ls.copyChunk(bw, buf, u.ID, i); err != nil {
+			return err
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+	}
+	// 文件末尾的空洞
+	if len(u.Holes) > 0 {
+		if err = res.Truncate(u.Size); err != nil {
+			return err
+		}
+	}
+	return commitHidden(res, fn)
+}
+
+// copyChunk 把第idx个拆分文件写入w
+func (ls *LocalStorage) copyChunk(w io.Writer, buf []byte, id string, idx int) error {
+	fp, err := os.OpenFile(ls.chunkName(id, idx), os.O_RDONLY, 0766)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	br := bufio.NewReader(fp)
+	for {
+		n, err := br.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if _, err = w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("write chunk %d: %s", idx, err)
+		}
+	}
+}
+
+// Abort 删除临时文件夹
+func (ls *LocalStorage) Abort(id string) error {
+	return os.RemoveAll(ls.dirName(id))
+}
+
+// Temps 列出所有上传会话的临时文件夹
+func (ls *LocalStorage) Temps() ([]*FileInfo, error) {
+	entries, err := os.ReadDir(ls.sessionsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var temps []*FileInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		temp, err := dirUsage(ls.dirName(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		temp.Name = entry.Name()
+		temps = append(temps, temp)
+	}
+	return temps, nil
+}
+
+// dirUsage 返回文件夹中文件的总大小和最后修改时间
+func dirUsage(dir string) (*FileInfo, error) {
+	usage := &FileInfo{}
+	err := filepath.Walk(dir, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			usage.Size += info.Size()
+		}
+		if info.ModTime().After(usage.ModTime) {
+			usage.ModTime = info.ModTime()
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// ReadTemp 读取临时文件夹中的元数据文件
+func (ls *LocalStorage) ReadTemp(id, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(ls.dirName(id), key))
+}
+
+// WriteTemp 写入临时文件夹中的元数据文件
+func (ls *LocalStorage) WriteTemp(id, key string, data []byte) error {
+	return os.WriteFile(filepath.Join(ls.dirName(id), key), data, 0600)
+}
+
+// Open 打开最终文件
+func (ls *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(ls.path(name))
+}
+
+// ReadFile 读取文件
+func (ls *LocalStorage) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(ls.path(name))
+}
+
+// WriteFile 写入文件，写入完成后才替换原来的文件
+func (ls *LocalStorage) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(ls.path(name)), 0777); err != nil {
+		return err
+	}
+	fp, err := createHidden(ls.path(name))
+	if err != nil {
+		return err
+	}
+	defer removeHidden(fp)
+	if _, err = fp.Write(data); err != nil {
+		return err
+	}
+	return commitHidden(fp, ls.path(name))
+}
+
+// createHidden 在fn所在的目录创建隐藏的临时文件：.{file.name}.{random}.tmp
+func createHidden(fn string) (*os.File, error) {
+	dir, base := filepath.Split(fn)
+	for {
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.%s.tmp", base, strconv.FormatInt(time.Now().UnixNano(), 36)))
+		fp, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0766)
+		if os.IsExist(err) {
+			continue
+		}
+		return fp, err
+	}
+}
+
+// commitHidden 临时文件落盘后重命名为fn，并同步目录保证重命名落盘
+func commitHidden(fp *os.File, fn string) error {
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fp.Name(), fn); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fn))
+}
+
+// removeHidden 关闭并删除没有提交的临时文件，已提交时什么都不做
+func removeHidden(fp *os.File) {
+	fp.Close()
+	if err := os.Remove(fp.Name()); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除临时文件错误, fn:%s, err:%s\n", fp.Name(), err)
+	}
+}
+
+// syncDir 同步目录
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove 删除文件
+func (ls *LocalStorage) Remove(name string) error {
+	if err := os.Remove(ls.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat 返回文件的信息
+func (ls *LocalStorage) Stat(name string) (*FileInfo, error) {
+	info, err := os.Stat(ls.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Rename 重命名文件
+func (ls *LocalStorage) Rename(oldName, newName string) error {
+	if err := os.MkdirAll(filepath.Dir(ls.path(newName)), 0777); err != nil {
+		return err
+	}
+	return os.Rename(ls.path(oldName), ls.path(newName))
+}
+
+// SetMeta 设置文件的扩展属性、权限和修改时间
+// 扩展属性需要文件可写，先设置扩展属性再修改权限
+func (ls *LocalStorage) SetMeta(name string, meta *FileMeta) error {
+	fn := ls.path(name)
+	for k, v := range meta.Xattrs {
+		if err := setxattr(fn, k, v); err != nil {
+			return err
+		}
+	}
+	if meta.Mode != 0 {
+		if err := os.Chmod(fn, meta.Mode); err != nil {
+			return err
+		}
+	}
+	if !meta.ModTime.IsZero() {
+		return os.Chtimes(fn, meta.ModTime, meta.ModTime)
+	}
+	return nil
+}
+
+// Mkdir 创建目录
+func (ls *LocalStorage) Mkdir(name string) error {
+	return os.MkdirAll(ls.path(name), 0777)
+}
+
+// Free 返回上传根目录所在文件系统的可用空间，根目录还没有创建时使用已存在的上级目录
+func (ls *LocalStorage) Free() (int64, error) {
+	dir := ls.root
+	for {
+		free, err := diskFree(dir)
+		if !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return free, err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// List 遍历目录列出所有文件和子目录
+func (ls *LocalStorage) List(dir string) ([]*FileInfo, error) {
+	var files []*FileInfo
+	top := ls.path(dir)
+	err := filepath.WalkDir(top, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fn == top {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.root, fn)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !listed(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			files = append(files, &FileInfo{Name: name + "/", ModTime: info.ModTime()})
+			return nil
+		}
+		files = append(files, &FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errExists 目标文件已存在
+var errExists = fmt.Errorf("file exists")
+
+// manageDeal 处理用户空间中文件的列出、查询、删除和移动，文件名按用户目录检查
+func manageDeal(conn net.Conn, usr *user, opType int, pstr string, opts map[string]string) {
+	var fn string
+	var err error
+	if opType == listType {
+		fn, err = userDir(usr, pstr)
+	} else {
+		fn, err = userPath(usr, pstr)
+	}
+	if err != nil {
+		log.Printf("文件名不合法, usr:%s, fn:%s\n", usr.name, pstr)
+		writeBufferTimeOut(conn, []byte("badpath\n"))
+		return
+	}
+	switch opType {
+	case listType:
+		if sendList(conn, fn) {
+			audit("list", usr.name, fn, "")
+		}
+		break
+	case statType:
+		if sendStat(conn, fn) {
+			audit("stat", usr.name, fn, "")
+		}
+		break
+	case deleteType:
+		writeBufferTimeOut(conn, []byte(removeUserFile(usr, fn)))
+		break
+	case moveType:
+		to, err := userPath(usr, opts["to"])
+		if err != nil {
+			log.Printf("文件名不合法, usr:%s, to:%s\n", usr.name, opts["to"])
+			writeBufferTimeOut(conn, []byte("badpath\n"))
+			return
+		}
+		writeBufferTimeOut(conn, []byte(moveUserFile(usr, fn, to)))
+		break
+	}
+}
+
+// userDir 返回客户端目录在存储中的目录，为空或者/时为用户目录
+func userDir(usr *user, dir string) (string, error) {
+	dir = strings.TrimRight(strings.Replace(dir, "\\", "/", -1), "/")
+	if dir == "" || dir == "." {
+		return usr.name, nil
+	}
+	return userPath(usr, dir)
+}
+
+// sendList 回复客户端目录中的文件和子目录（不包括下级目录中的文件），按名称排序，发送完成后关闭连接
+// 协议：每行一项：type={f|d} size={size} mtime={unix_nano} name={name}，name为目录中的名称，最终文件的元数据文件不列出
+// 端到端加密的文件size为.enc元数据中的明文大小
+// 返回是否成功列出
+func sendList(conn net.Conn, dir string) bool {
+	infos, err := Store.List(dir)
+	if err != nil {
+		log.Printf("列出目录失败, dir:%s, err:%s\n", dir, err)
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return false
+	}
+	entries := make(map[string]*FileInfo)
+	for _, info := range infos {
+		rel := strings.TrimPrefix(info.Name, dir+"/")
+		// 下级目录中的文件只列出所在的子目录
+		if i := strings.Index(rel, "/"); i >= 0 {
+			if i == len(rel)-1 {
+				entries[rel] = info
+			} else if _, ok := entries[rel[:i+1]]; !ok {
+				entries[rel[:i+1]] = &FileInfo{Name: rel[:i+1]}
+			}
+			continue
+		}
+		entries[rel] = info
+	}
+	var list []string
+	for name := range entries {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	var b strings.Builder
+	for _, name := range list {
+		info := entries[name]
+		typ := "f"
+		if strings.HasSuffix(name, "/") {
+			typ = "d"
+		}
+		var mtime int64
+		if !info.ModTime.IsZero() {
+			mtime = info.ModTime.UnixNano()
+		}
+		size := info.Size
+		if typ == "f" {
+			meta, err := loadE2E(info.Name)
+			if err != nil {
+				log.Printf("读取加密元数据失败, fn:%s, err:%s\n", info.Name, err)
+				writeBufferTimeOut(conn, []byte("fail\n"))
+				return false
+			}
+			if meta != nil {
+				size = meta.size
+			}
+		}
+		fmt.Fprintf(&b, "type=%s size=%d mtime=%d name=%s\n", typ, size, mtime, strings.TrimSuffix(name, "/"))
+	}
+	return writeBufferTimeOut(conn, []byte(b.String())) == nil
+}
+
+// sendStat 回复客户端文件的大小、修改时间和sha256，静态加密的文件按解密后的内容计算
+// 端到端加密的文件服务端不能解密，size为明文大小，sha256为保存的密文的sha256
+// 协议：size={size} mtime={unix_nano} sha256={sum}，文件不存在时回复notfound，失败时回复fail
+// 返回是否成功回复文件信息
+func sendStat(conn net.Conn, name string) bool {
+	snap, err := openSnapshot(name, 0, 0)
+	if err != nil {
+		log.Printf("查询文件失败, fn:%s, err:%s\n", name, err)
+		if os.IsNotExist(err) {
+			writeBufferTimeOut(conn, []byte("notfound"))
+			return false
+		}
+		writeBufferTimeOut(conn, []byte("fail"))
+		return false
+	}
+	defer snap.rc.Close()
+	info := snap.info
+	size := info.Size
+	if snap.meta != nil {
+		size = snap.meta.size
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, snap.rc); err != nil {
+		log.Printf("计算文件sha256失败, fn:%s, err:%s\n", name, err)
+		writeBufferTimeOut(conn, []byte("fail"))
+		return false
+	}
+	return writeBufferTimeOut(conn, []byte(fmt.Sprintf("size=%d mtime=%d sha256=%x", size, info.ModTime.UnixNano(), h.Sum(nil)))) == nil
+}
+
+// removeUserFile 删除用户的文件以及历史版本，返回回复客户端的结果：success、notfound或者fail
+func removeUserFile(usr *user, name string) string {
+	if _, err := Store.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return "notfound"
+		}
+		return "fail"
+	}
+	if err := deleteFile(name); err != nil {
+		log.Printf("删除文件失败, usr:%s, fn:%s, err:%s\n", usr.name, name, err)
+		return "fail"
+	}
+	audit("delete", usr.name, name, "")
+	return "success"
+}
+
+// moveUserFile 移动用户的文件，返回回复客户端的结果：success、notfound、exists或者fail
+func moveUserFile(usr *user, from, to string) string {
+	if err := moveVersioned(from, to); err != nil {
+		log.Printf("移动文件失败, usr:%s, from:%s, to:%s, err:%s\n", usr.name, from, to, err)
+		switch {
+		case err == errExists:
+			return "exists"
+		case os.IsNotExist(err):
+			return "notfound"
+		}
+		return "fail"
+	}
+	audit("move", usr.name, from, "to="+strconv.Quote(to))
+	return "success"
+}
+
+// moveVersioned 移动文件，同时移动元数据文件和历史版本，目标文件已存在时返回errExists
+func moveVersioned(from, to string) error {
+	if from == to {
+		return nil
+	}
+	// 按名称顺序加锁，避免两个方向相反的移动互相等待
+	first, second := from, to
+	if second < first {
+		first, second = second, first
+	}
+	unlock1, err := lockFile(first)
+	if err != nil {
+		return err
+	}
+	defer unlock1()
+	unlock2, err := lockFile(second)
+	if err != nil {
+		return err
+	}
+	defer unlock2()
+	if _, err := Store.Stat(from); err != nil {
+		return err
+	}
+	if _, err := Store.Stat(to); err == nil {
+		return errExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	vers, err := loadVersions(from)
+	if err != nil {
+		return err
+	}
+	for i, v := range vers {
+		if i == len(vers)-1 {
+			break
+		}
+		if err = moveFile(versionName(from, v.id), versionName(to, v.id)); err != nil {
+			return err
+		}
+	}
+	if len(vers) > 0 {
+		if err = saveVersions(to, vers); err != nil {
+			return err
+		}
+		if err = Store.Remove(path.Join(versionDir(from), "index")); err != nil {
+			return err
+		}
+	}
+	return moveFile(from, to)
+}
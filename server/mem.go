@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStorage 内存存储，服务重启后数据丢失，用于测试
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte            // 最终文件, key=name
+	mtime map[string]time.Time         // 最终文件的修改时间, key=name
+	dirs  map[string]bool              // 创建的目录, key=name
+	temp  map[string]map[string][]byte // 上传会话的拆分文件和元数据, key=id
+	ttime map[string]time.Time         // 上传会话的最后写入时间, key=id
+}
+
+// NewMemStorage 创建内存存储
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		files: make(map[string][]byte),
+		mtime: make(map[string]time.Time),
+		dirs:  make(map[string]bool),
+		temp:  make(map[string]map[string][]byte),
+		ttime: make(map[string]time.Time),
+	}
+}
+
+// notExist 返回数据不存在的错误
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// Prepare 创建上传会话的临时存储
+func (ms *MemStorage) Prepare(u *Upload) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.temp[u.ID]; !ok {
+		ms.temp[u.ID] = make(map[string][]byte)
+		ms.ttime[u.ID] = time.Now()
+	}
+	return nil
+}
+
+// Offset 返回拆分文件的大小
+func (ms *MemStorage) Offset(u *Upload, idx int) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return int64(len(ms.temp[u.ID][strconv.Itoa(idx)])), nil
+}
+
+// Append 打开拆分文件，写入的数据追加在末尾
+func (ms *MemStorage) Append(u *Upload, idx int) (io.WriteCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.temp[u.ID]; !ok {
+		return nil, notExist("append", u.ID)
+	}
+	return &memChunk{ms: ms, id: u.ID, key: strconv.Itoa(idx)}, nil
+}
+
+// ReadChunk 读取拆分文件
+func (ms *MemStorage) ReadChunk(u *Upload, idx int) (io.ReadCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data := append([]byte(nil), ms.temp[u.ID][strconv.Itoa(idx)]...)
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// ResetChunk 删除拆分文件
+func (ms *MemStorage) ResetChunk(u *Upload, idx int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.temp[u.ID], strconv.Itoa(idx))
+	return nil
+}
+
+// Assemble 拼接拆分文件生成最终文件
+func (ms *MemStorage) Assemble(u *Upload) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	chunks, ok := ms.temp[u.ID]
+	if !ok {
+		return notExist("assemble", u.ID)
+	}
+	var buf bytes.Buffer
+	for i := 0; i < u.Num; i++ {
+		if u.Holes[i] {
+			buf.Write(make([]byte, u.chunkSize(i)))
+			continue
+		}
+		buf.Write(chunks[strconv.Itoa(i)])
+	}
+	ms.files[u.Name] = buf.Bytes()
+	ms.mtime[u.Name] = time.Now()
+	delete(ms.temp, u.ID)
+	delete(ms.ttime, u.ID)
+	return nil
+}
+
+// Abort 删除上传会话的临时存储
+func (ms *MemStorage) Abort(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.temp, id)
+	delete(ms.ttime, id)
+	return nil
+}
+
+// Temps 列出所有上传会话
+func (ms *MemStorage) Temps() ([]*FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var temps []*FileInfo
+	for id, chunks := range ms.temp {
+		info := &FileInfo{Name: id, ModTime: ms.ttime[id]}
+		for _, data := range chunks {
+			info.Size += int64(len(data))
+		}
+		temps = append(temps, info)
+	}
+	return temps, nil
+}
+
+// ReadTemp 读取上传会话的元数据
+func (ms *MemStorage) ReadTemp(id, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, ok := ms.temp[id][key]
+	if !ok {
+		return nil, notExist("read", id+"/"+key)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// WriteTemp 保存上传会话的元数据
+func (ms *MemStorage) WriteTemp(id, key string, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	chunks, ok := ms.temp[id]
+	if !ok {
+		return notExist("write", id)
+	}
+	chunks[key] = append([]byte(nil), data...)
+	ms.ttime[id] = time.Now()
+	return nil
+}
+
+// Open 读取最终文件
+func (ms *MemStorage) Open(name string) (io.ReadCloser, error) {
+	data, err := ms.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// ReadFile 读取文件
+func (ms *MemStorage) ReadFile(name string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, ok := ms.files[name]
+	if !ok {
+		return nil, notExist("read", name)
+	}
+	return data, nil
+}
+
+// WriteFile 写入文件
+func (ms *MemStorage) WriteFile(name string, data []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.files[name] = append([]byte(nil), data...)
+	ms.mtime[name] = time.Now()
+	return nil
+}
+
+// Remove 删除文件
+func (ms *MemStorage) Remove(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.files, name)
+	delete(ms.mtime, name)
+	return nil
+}
+
+// Stat 返回文件的信息
+func (ms *MemStorage) Stat(name string) (*FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, ok := ms.files[name]
+	if !ok {
+		if ms.isDir(name) {
+			return &FileInfo{Name: name}, nil
+		}
+		return nil, notExist("stat", name)
+	}
+	return &FileInfo{Name: name, Size: int64(len(data)), ModTime: ms.mtime[name]}, nil
+}
+
+// Rename 重命名文件，oldName是目录时移动目录中的所有文件和子目录
+func (ms *MemStorage) Rename(oldName, newName string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.files[oldName]; ok {
+		ms.move(oldName, newName)
+		return nil
+	}
+	if !ms.isDir(oldName) {
+		return notExist("rename", oldName)
+	}
+	// 先收集再移动，遍历map时不添加新的key
+	var files, dirs []string
+	for name := range ms.files {
+		if strings.HasPrefix(name, oldName+"/") {
+			files = append(files, name)
+		}
+	}
+	for name := range ms.dirs {
+		if name == oldName || strings.HasPrefix(name, oldName+"/") {
+			dirs = append(dirs, name)
+		}
+	}
+	for _, name := range files {
+		ms.move(name, newName+strings.TrimPrefix(name, oldName))
+	}
+	for _, name := range dirs {
+		delete(ms.dirs, name)
+		ms.dirs[newName+strings.TrimPrefix(name, oldName)] = true
+	}
+	return nil
+}
+
+// move 移动一个文件，调用时已加锁
+func (ms *MemStorage) move(oldName, newName string) {
+	ms.files[newName], ms.mtime[newName] = ms.files[oldName], ms.mtime[oldName]
+	delete(ms.files, oldName)
+	delete(ms.mtime, oldName)
+}
+
+// isDir 返回name是否是Mkdir创建的目录或者有文件在name目录中，调用时已加锁
+func (ms *MemStorage) isDir(name string) bool {
+	if ms.dirs[name] {
+		return true
+	}
+	for fn := range ms.files {
+		if strings.HasPrefix(fn, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMeta 设置文件的修改时间，内存存储不保存权限和扩展属性
+func (ms *MemStorage) SetMeta(name string, meta *FileMeta) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.files[name]; !ok {
+		return notExist("setmeta", name)
+	}
+	if !meta.ModTime.IsZero() {
+		ms.mtime[name] = meta.ModTime
+	}
+	return nil
+}
+
+// Mkdir 记录目录，内存存储的文件不依赖目录
+func (ms *MemStorage) Mkdir(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.dirs[name] = true
+	return nil
+}
+
+// Free 内存存储不限制空间
+func (ms *MemStorage) Free() (int64, error) {
+	return -1, nil
+}
+
+// List 列出目录中的所有文件和Mkdir创建的子目录
+func (ms *MemStorage) List(dir string) ([]*FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var files []*FileInfo
+	for name, data := range ms.files {
+		if dir != "" && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		if !listed(name) {
+			continue
+		}
+		files = append(files, &FileInfo{Name: name, Size: int64(len(data)), ModTime: ms.mtime[name]})
+	}
+	for name := range ms.dirs {
+		if dir != "" && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		files = append(files, &FileInfo{Name: name + "/"})
+	}
+	return files, nil
+}
+
+// memChunk 内存中的拆分文件
+type memChunk struct {
+	ms  *MemStorage
+	id  string
+	key string
+}
+
+// Write 追加数据
+func (mc *memChunk) Write(p []byte) (int, error) {
+	mc.ms.mu.Lock()
+	defer mc.ms.mu.Unlock()
+	chunks, ok := mc.ms.temp[mc.id]
+	if !ok {
+		return 0, notExist("write", mc.id)
+	}
+	chunks[mc.key] = append(chunks[mc.key], p...)
+	mc.ms.ttime[mc.id] = time.Now()
+	return len(p), nil
+}
+
+// Close 数据已经写入，不需要额外操作
+func (mc *memChunk) Close() error {
+	return nil
+}
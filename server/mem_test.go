@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeChunk 追加写入拆分文件
+func writeChunk(t *testing.T, st Storage, u *Upload, idx int, data string) {
+	t.Helper()
+	w, err := st.Append(u, idx)
+	if err != nil {
+		t.Fatalf("append %d: %s", idx, err)
+	}
+	if _, err = w.Write([]byte(data)); err != nil {
+		t.Fatalf("write %d: %s", idx, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("close %d: %s", idx, err)
+	}
+}
+
+func TestMemStorageAssemble(t *testing.T) {
+	ms := NewMemStorage()
+	u := &Upload{ID: "s1", Name: "u/a.txt", Size: 10, Chunk: 4, Num: 3, Holes: map[int]bool{1: true}}
+	if err := ms.Prepare(u); err != nil {
+		t.Fatal(err)
+	}
+	// 续传时追加在已写入的数据后
+	writeChunk(t, ms, u, 0, "ab")
+	writeChunk(t, ms, u, 0, "cd")
+	writeChunk(t, ms, u, 2, "ef")
+	if off, _ := ms.Offset(u, 0); off != 4 {
+		t.Fatalf("offset = %d, want 4", off)
+	}
+	if off, _ := ms.Offset(u, 1); off != 0 {
+		t.Fatalf("offset of hole = %d, want 0", off)
+	}
+	if err := ms.WriteTemp(u.ID, "enc", []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ms.ReadTemp(u.ID, "enc"); err != nil || string(b) != "meta" {
+		t.Fatalf("read temp = %q, %v", b, err)
+	}
+	temps, _ := ms.Temps()
+	if len(temps) != 1 || temps[0].Name != "s1" {
+		t.Fatalf("temps = %v", temps)
+	}
+	if err := ms.Assemble(u); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ms.ReadFile("u/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 空洞写入0
+	if want := []byte("abcd\x00\x00\x00\x00ef"); !bytes.Equal(b, want) {
+		t.Fatalf("assembled = %q, want %q", b, want)
+	}
+	// 组装后删除临时存储
+	if temps, _ = ms.Temps(); len(temps) != 0 {
+		t.Fatalf("temps after assemble = %v", temps)
+	}
+	if _, err = ms.Append(u, 0); !os.IsNotExist(err) {
+		t.Fatalf("append after assemble: %v", err)
+	}
+}
+
+func TestMemStorageResetChunk(t *testing.T) {
+	ms := NewMemStorage()
+	u := &Upload{ID: "s2", Name: "u/b.txt", Size: 4, Chunk: 4, Num: 1}
+	ms.Prepare(u)
+	writeChunk(t, ms, u, 0, "old!")
+	if err := ms.ResetChunk(u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if off, _ := ms.Offset(u, 0); off != 0 {
+		t.Fatalf("offset after reset = %d", off)
+	}
+	writeChunk(t, ms, u, 0, "new!")
+	rc, err := ms.ReadChunk(u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, _ := io.ReadAll(rc); string(b) != "new!" {
+		t.Fatalf("chunk = %q", b)
+	}
+	if err = ms.Abort(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ms.ReadTemp(u.ID, "enc"); !os.IsNotExist(err) {
+		t.Fatalf("read temp after abort: %v", err)
+	}
+}
+
+func TestMemStorageFiles(t *testing.T) {
+	ms := NewMemStorage()
+	if _, err := ms.ReadFile("u/none"); !os.IsNotExist(err) {
+		t.Fatalf("read missing: %v", err)
+	}
+	if _, err := ms.Stat("u/none"); !os.IsNotExist(err) {
+		t.Fatalf("stat missing: %v", err)
+	}
+	if _, err := ms.Open("u/none"); !os.IsNotExist(err) {
+		t.Fatalf("open missing: %v", err)
+	}
+	if err := ms.Rename("u/none", "u/x"); !os.IsNotExist(err) {
+		t.Fatalf("rename missing: %v", err)
+	}
+	if err := ms.Remove("u/none"); err != nil {
+		t.Fatalf("remove missing: %v", err)
+	}
+	ms.WriteFile("u/a.txt", []byte("hello"))
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := ms.SetMeta("u/a.txt", &FileMeta{ModTime: mtime}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Rename("u/a.txt", "u/d/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Stat("u/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("stat renamed: %v", err)
+	}
+	info, err := ms.Stat("u/d/b.txt")
+	if err != nil || info.Size != 5 || !info.ModTime.Equal(mtime) {
+		t.Fatalf("stat = %+v, %v", info, err)
+	}
+	rc, err := ms.Open("u/d/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "hello" {
+		t.Fatalf("open = %q", b)
+	}
+	ms.Mkdir("u/empty")
+	ms.WriteFile("u/.versions/d/b.txt/1", []byte("old"))
+	ms.WriteFile("other/c.txt", []byte("c"))
+	infos, err := ms.List("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	// 历史版本不列出，目录以/结尾
+	if want := []string{"u/d/b.txt", "u/empty/"}; !equalStrings(names, want) {
+		t.Fatalf("list = %v, want %v", names, want)
+	}
+	// 移动目录时移动目录中的文件和子目录
+	ms.Mkdir("u/d/sub")
+	if err := ms.Rename("u/d", "u/m"); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ = ms.List("u/m")
+	names = nil
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"u/m/b.txt", "u/m/sub/"}; !equalStrings(names, want) {
+		t.Fatalf("list moved = %v, want %v", names, want)
+	}
+	if _, err := ms.Stat("u/d"); !os.IsNotExist(err) {
+		t.Fatalf("stat moved dir: %v", err)
+	}
+	if free, _ := ms.Free(); free >= 0 {
+		t.Fatalf("free = %d, want unlimited", free)
+	}
+}
+
+// equalStrings 两个字符串列表是否相同
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xattrNamespace 服务端只设置用户命名空间的扩展属性，其他命名空间需要特权或者影响安全策略
+const xattrNamespace = "user."
+
+// parseMeta 解析客户端上传的文件元数据
+// 协议：[mtime={unix_nano}] [mode={octal}] [xattr={name}:{value},...]，扩展属性的名称和值使用base64 url编码（无填充）
+// 没有元数据时返回nil
+func parseMeta(opts map[string]string) (*FileMeta, error) {
+	if opts["mtime"] == "" && opts["mode"] == "" && opts["xattr"] == "" {
+		return nil, nil
+	}
+	meta := &FileMeta{}
+	if opts["mtime"] != "" {
+		ns, err := strconv.ParseInt(opts["mtime"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("mtime error: %s", opts["mtime"])
+		}
+		meta.ModTime = time.Unix(0, ns)
+	}
+	if opts["mode"] != "" {
+		mode, err := strconv.ParseUint(opts["mode"], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("mode error: %s", opts["mode"])
+		}
+		// 只保留权限位，不设置setuid等特殊位
+		meta.Mode = os.FileMode(mode) & os.ModePerm
+	}
+	if opts["xattr"] != "" {
+		xattrs, err := decodeXattrs(opts["xattr"])
+		if err != nil {
+			return nil, err
+		}
+		meta.Xattrs = xattrs
+	}
+	return meta, nil
+}
+
+// String 返回元数据的协议格式，用于会话记录和对象存储的元数据
+func (meta *FileMeta) String() string {
+	var opts []string
+	if !meta.ModTime.IsZero() {
+		opts = append(opts, fmt.Sprintf("mtime=%d", meta.ModTime.UnixNano()))
+	}
+	if meta.Mode != 0 {
+		opts = append(opts, fmt.Sprintf("mode=%o", meta.Mode))
+	}
+	if len(meta.Xattrs) > 0 {
+		opts = append(opts, "xattr="+encodeXattrs(meta.Xattrs))
+	}
+	return strings.Join(opts, " ")
+}
+
+// decodeXattrs 解析扩展属性，忽略用户命名空间之外的扩展属性
+func decodeXattrs(str string) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	for _, kv := range strings.Split(str, ",") {
+		pair := strings.SplitN(kv, ":", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("xattr error: %s", kv)
+		}
+		name, err := base64.RawURLEncoding.DecodeString(pair[0])
+		if err != nil {
+			return nil, fmt.Errorf("xattr error: %s", kv)
+		}
+		value, err := base64.RawURLEncoding.DecodeString(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("xattr error: %s", kv)
+		}
+		if !strings.HasPrefix(string(name), xattrNamespace) {
+			log.Printf("忽略扩展属性, name:%q\n", name)
+			continue
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+// encodeXattrs 编码扩展属性：{name}:{value},...
+func encodeXattrs(xattrs map[string][]byte) string {
+	var pairs []string
+	for name, value := range xattrs {
+		pairs = append(pairs, base64.RawURLEncoding.EncodeToString([]byte(name))+":"+base64.RawURLEncoding.EncodeToString(value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// applyMeta 组装完成后设置组装的文件name的元数据，失败时只记录日志，不影响上传结果
+func (fs *fileServer) applyMeta(name string) {
+	if fs.meta == nil {
+		return
+	}
+	if err := Store.SetMeta(name, fs.meta); err != nil {
+		log.Printf("设置文件元数据错误, uid:%s, fn:%s, err:%s\n", fs.uid, fs.fn, err)
+	}
+}
+
+// uploadedExt 记录文件上传到服务端的时间的元数据文件后缀，内容为unix纳秒
+// 最终文件的修改时间是源文件的修改时间，保留规则按上传时间计算
+const uploadedExt = ".uploaded"
+
+// saveUploaded 保存文件name的上传时间
+func saveUploaded(name string) error {
+	return Store.WriteFile(metaName(name, uploadedExt), []byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+}
+
+// uploadedAt 返回文件上传到服务端的时间，没有记录时（记录上传时间之前上传的文件）使用修改时间
+func uploadedAt(info *FileInfo) time.Time {
+	b, err := Store.ReadFile(metaName(info.Name, uploadedExt))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取上传时间失败, name:%s, err:%s\n", info.Name, err)
+		}
+		return info.ModTime
+	}
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		log.Printf("上传时间错误, name:%s, time:%s\n", info.Name, b)
+		return info.ModTime
+	}
+	return time.Unix(0, ns)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// errBadPath 客户端文件名不合法，回复客户端badpath
+var errBadPath = fmt.Errorf("bad path")
+
+// maxNameLen 路径中每一级名称的最大字节数
+const maxNameLen = 255
+
+// windows保留的设备名，不区分大小写，带扩展名时同样保留
+var deviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// userPath 返回客户端文件名在存储中的文件名：{user}/{file.name}
+func userPath(usr *user, fn string) (string, error) {
+	name, err := cleanName(fn)
+	if err != nil {
+		return "", err
+	}
+	return usr.name + "/" + name, nil
+}
+
+// cleanName 把客户端文件名转换为规范的相对路径，使用/分隔
+// 去掉windows盘符、空的和.路径，拒绝..、设备名、控制字符和服务端保留的名称，保证文件只能保存在用户目录中
+func cleanName(fn string) (string, error) {
+	fn = strings.Replace(fn, "\\", "/", -1)
+	if len(fn) >= 2 && fn[1] == ':' && isLetter(fn[0]) {
+		fn = fn[2:]
+	}
+	if fn == "" || strings.HasSuffix(fn, "/") {
+		return "", errBadPath
+	}
+	var elems []string
+	for _, elem := range strings.Split(fn, "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		if !validElem(elem) {
+			return "", errBadPath
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "", errBadPath
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// validElem 路径中的一级名称是否合法
+func validElem(elem string) bool {
+	if elem == ".." || len(elem) > maxNameLen {
+		return false
+	}
+	for _, r := range elem {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	// 历史版本目录、元数据文件目录和组装用的隐藏文件
+	if elem == ".versions" || elem == metaDir || (strings.HasPrefix(elem, ".") && strings.HasSuffix(elem, ".tmp")) {
+		return false
+	}
+	dev := strings.ToUpper(strings.TrimRight(elem, ". "))
+	if i := strings.Index(dev, "."); i >= 0 {
+		dev = dev[:i]
+	}
+	return !deviceNames[strings.TrimSpace(dev)]
+}
+
+// listed 存储中的名称是否需要列出，上传会话、副本的代数记录、历史版本、元数据文件和组装用的隐藏文件不列出
+func listed(name string) bool {
+	for _, dir := range []string{".sessions", genDir} {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return false
+		}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !validElem(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLetter 是否是英文字母
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	long := strings.Repeat("a", maxNameLen)
+	tests := []struct {
+		fn   string
+		want string // 为空时应返回errBadPath
+	}{
+		{"a.txt", "a.txt"},
+		{"dir/sub/a.txt", "dir/sub/a.txt"},
+		{"/a//b/./c", "a/b/c"},
+		{`dir\sub\a.txt`, "dir/sub/a.txt"},
+		{`C:\x`, "x"},
+		{"c:/dir/x", "dir/x"},
+		{"中文 文件.txt", "中文 文件.txt"},
+		{"console.txt", "console.txt"},
+		{"COM10", "COM10"},
+		{".hidden", ".hidden"},
+		{long, long},
+		// 上级目录
+		{"..", ""},
+		{"a/../b", ""},
+		{`..\x`, ""},
+		// 空路径和目录
+		{"", ""},
+		{".", ""},
+		{"/", ""},
+		{`\\`, ""},
+		{"C:", ""},
+		{"a/", ""},
+		// 控制字符
+		{"a\x00b", ""},
+		{"a\x1fb", ""},
+		{"a\nb", ""},
+		{"a\x7fb", ""},
+		// windows设备名，不区分大小写，忽略扩展名和结尾的点和空格
+		{"con", ""},
+		{"con.txt", ""},
+		{"dir/NUL.tar.gz", ""},
+		{"LPT1 .", ""},
+		{"com9. ", ""},
+		// 超长的名称
+		{long + "a", ""},
+		{"dir/" + long + "a/x", ""},
+		// 服务端保留的名称
+		{".versions", ""},
+		{"dir/.versions/a", ""},
+		{metaDir, ""},
+		{"dir/" + metaDir + "/a.txt.key", ""},
+		{".a.txt.tmp", ""},
+	}
+	for _, tt := range tests {
+		got, err := cleanName(tt.fn)
+		if tt.want == "" {
+			if err != errBadPath {
+				t.Errorf("cleanName(%q) = %q, %v, want errBadPath", tt.fn, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanName(%q) = %q, %v, want %q", tt.fn, got, err, tt.want)
+		}
+	}
+}
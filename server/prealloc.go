@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// PreallocStorage 预分配最终文件的本地存储
+// 上传开始时按最终大小预分配{root}/.sessions/{id}/data，拆分文件直接写入各自的偏移
+// 每个拆分文件已写入的字节数记录在{root}/.sessions/{id}/journal中，每条记录8个字节
+// 组装时只需要校验记录并把data重命名为最终文件，不需要再复制数据
+type PreallocStorage struct {
+	*LocalStorage
+}
+
+// NewPreallocStorage 创建预分配最终文件的本地存储
+func NewPreallocStorage(root string) *PreallocStorage {
+	return &PreallocStorage{NewLocalStorage(root)}
+}
+
+// dataName 返回预分配的数据文件
+func (ps *PreallocStorage) dataName(id string) string {
+	return filepath.Join(ps.dirName(id), "data")
+}
+
+// journalName 返回记录拆分文件写入进度的文件
+func (ps *PreallocStorage) journalName(id string) string {
+	return filepath.Join(ps.dirName(id), "journal")
+}
+
+// Prepare 预分配数据文件和进度记录，已存在且大小一致时保留用于续传
+func (ps *PreallocStorage) Prepare(u *Upload) error {
+	if err := os.MkdirAll(ps.dirName(u.ID), 0777); err != nil {
+		return err
+	}
+	dinfo, derr := os.Stat(ps.dataName(u.ID))
+	jinfo, jerr := os.Stat(ps.journalName(u.ID))
+	if derr == nil && jerr == nil && dinfo.Size() == u.Size && jinfo.Size() == int64(u.Num)*8 {
+		return nil
+	}
+	log.Printf("预分配文件, name:%s, size:%d, num:%d\n", u.Name, u.Size, u.Num)
+	data, err := os.OpenFile(ps.dataName(u.ID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0766)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	// 有空洞时不预分配，没有写入的空洞保持稀疏
+	if len(u.Holes) > 0 {
+		err = data.Truncate(u.Size)
+	} else {
+		err = fallocate(data, u.Size)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ps.journalName(u.ID), make([]byte, u.Num*8), 0600)
+}
+
+// Offset 从进度记录中读取拆分文件已写入的字节数
+func (ps *PreallocStorage) Offset(u *Upload, idx int) (int64, error) {
+	jf, err := os.Open(ps.journalName(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	defer jf.Close()
+	rec := make([]byte, 8)
+	if _, err = jf.ReadAt(rec, int64(idx)*8); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(rec)), nil
+}
+
+// Append 打开数据文件，从拆分文件的续传位置开始写入
+func (ps *PreallocStorage) Append(u *Upload, idx int) (io.WriteCloser, error) {
+	off, err := ps.Offset(u, idx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(ps.dataName(u.ID), os.O_WRONLY, 0766)
+	if err != nil {
+		return nil, err
+	}
+	return &preallocChunk{
+		ps:    ps,
+		data:  data,
+		id:    u.ID,
+		idx:   idx,
+		start: int64(idx) * u.Chunk,
+		off:   off,
+		max:   u.chunkSize(idx),
+	}, nil
+}
+
+// ReadChunk 从数据文件读取拆分文件已写入的部分
+func (ps *PreallocStorage) ReadChunk(u *Upload, idx int) (io.ReadCloser, error) {
+	off, err := ps.Offset(u, idx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.Open(ps.dataName(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(data, int64(idx)*u.Chunk, off), data}, nil
+}
+
+// ResetChunk 把拆分文件的进度记录清零，数据文件中的旧数据之后被覆盖
+func (ps *PreallocStorage) ResetChunk(u *Upload, idx int) error {
+	return ps.record(u.ID, idx, 0)
+}
+
+// record 更新拆分文件的进度记录并落盘
+func (ps *PreallocStorage) record(id string, idx int, off int64) error {
+	jf, err := os.OpenFile(ps.journalName(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer jf.Close()
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(off))
+	if _, err = jf.WriteAt(rec, int64(idx)*8); err != nil {
+		return err
+	}
+	return jf.Sync()
+}
+
+// Assemble 校验所有拆分文件写入完成后，把数据文件重命名为最终文件
+func (ps *PreallocStorage) Assemble(u *Upload) error {
+	for i := 0; i < u.Num; i++ {
+		if u.Holes[i] {
+			continue
+		}
+		off, err := ps.Offset(u, i)
+		if err != nil {
+			return err
+		}
+		if off != u.chunkSize(i) {
+			return fmt.Errorf("chunk %d incomplete: %d/%d", i, off, u.chunkSize(i))
+		}
+	}
+	// 拆分文件关闭时已经落盘，重命名是原子操作，读取方只会看到完整的文件
+	if err := os.MkdirAll(filepath.Dir(ps.path(u.Name)), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(ps.dataName(u.ID), ps.path(u.Name)); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(ps.path(u.Name))); err != nil {
+		return err
+	}
+	if err := ps.Abort(u.ID); err != nil {
+		log.Printf("删除文件错误, file name=%s\n", ps.dirName(u.ID))
+	}
+	return nil
+}
+
+// AssembleOverhead 组装时只重命名数据文件，不需要额外的空间
+func (ps *PreallocStorage) AssembleOverhead(u *Upload) int64 {
+	return 0
+}
+
+// preallocChunk 写入预分配数据文件的拆分文件
+type preallocChunk struct {
+	ps    *PreallocStorage
+	data  *os.File
+	id    string
+	idx   int
+	start int64 // 拆分文件在数据文件中的起始偏移
+	off   int64 // 已写入的字节数
+	max   int64 // 拆分文件的大小
+}
+
+// Write 写入拆分文件的当前位置
+func (pc *preallocChunk) Write(p []byte) (int, error) {
+	if pc.off+int64(len(p)) > pc.max {
+		return 0, fmt.Errorf("chunk %d overflow", pc.idx)
+	}
+	n, err := pc.data.WriteAt(p, pc.start+pc.off)
+	pc.off += int64(n)
+	return n, err
+}
+
+// Close 数据落盘后再更新进度记录，保证记录的进度不会超过实际写入的数据
+func (pc *preallocChunk) Close() error {
+	defer pc.data.Close()
+	if err := pc.data.Sync(); err != nil {
+		return err
+	}
+	return pc.ps.record(pc.id, pc.idx, pc.off)
+}
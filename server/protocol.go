@@ -8,21 +8,46 @@ import (
 )
 
 const (
-	bigType   = 1 // 大文件类型
-	splitType = 2 // 拆分文件类型
-	endType   = 4 // 上传结束
+	bigType      = 1     // 大文件类型
+	splitType    = 2     // 拆分文件类型
+	endType      = 4     // 上传结束
+	versionsType = 8     // 查询文件的版本
+	restoreType  = 16    // 恢复文件的历史版本
+	fetchType    = 32    // 下载文件的指定版本
+	mkdirType    = 64    // 创建目录
+	getType      = 128   // 查询文件的下载方案
+	partType     = 256   // 下载文件的一个拆分块
+	listType     = 512   // 列出目录
+	statType     = 1024  // 查询文件信息
+	deleteType   = 2048  // 删除文件
+	moveType     = 4096  // 移动文件
+	statusType   = 8192  // 查询上传会话的状态
+	resetType    = 16384 // 清空源文件变化后不一致的拆分文件
 )
 
 // analyzeOp 解析客户端的操作请求
-// 上传大文件：big {file_name} {file_size}
+// 上传大文件：big {file_name} {file_size} [{key}={value} ...]
 // 上传拆分后的文件：split {unique_id} {file_index}
 // 停止上传文件：stop {unique_id} {file_index}
 // 上传完成：end {unique_id} {file_index}
-func analyzeOp(opStr string) (int, string, int64, error) {
+// 查询上传会话的状态：status {unique_id} 0 [hash=1]
+// 清空拆分文件：reset {unique_id} 0 [idx={i,...}] [done=1]
+// 查询文件的版本：versions {file_name} 0
+// 恢复文件的历史版本：restore {file_name} {version}
+// 下载文件的指定版本：fetch {file_name} {version}
+// 创建目录：mkdir {dir_name} 0
+// 查询文件的下载方案：get {file_name} 0
+// 下载文件的拆分块：part {file_name} {chunk_index} [offset={n}]
+// 列出目录：list {dir_name} 0
+// 查询文件信息：stat {file_name} 0
+// 删除文件：delete {file_name} 0
+// 移动文件：move {file_name} 0 to={new_name}
+// 末尾可以携带可选参数，以key=value的形式给出
+func analyzeOp(opStr string) (int, string, int64, map[string]string, error) {
 	opArr := strings.Split(opStr, " ")
-	if len(opArr) != 3 {
+	if len(opArr) < 3 {
 		log.Printf("协议错误, %s\n", opStr)
-		return 0, "", 0, fmt.Errorf("protocol error")
+		return 0, "", 0, nil, fmt.Errorf("protocol error")
 	}
 	var t int
 	switch opArr[0] {
@@ -35,16 +60,70 @@ func analyzeOp(opStr string) (int, string, int64, error) {
 	case "end":
 		t = endType
 		break
+	case "status":
+		t = statusType
+		break
+	case "reset":
+		t = resetType
+		break
+	case "versions":
+		t = versionsType
+		break
+	case "restore":
+		t = restoreType
+		break
+	case "fetch":
+		t = fetchType
+		break
+	case "mkdir":
+		t = mkdirType
+		break
+	case "get":
+		t = getType
+		break
+	case "part":
+		t = partType
+		break
+	case "list":
+		t = listType
+		break
+	case "stat":
+		t = statType
+		break
+	case "delete":
+		t = deleteType
+		break
+	case "move":
+		t = moveType
+		break
 	default:
 		log.Printf("协议错误, %s\n", opStr)
-		return 0, "", 0, fmt.Errorf("protocol error")
+		return 0, "", 0, nil, fmt.Errorf("protocol error")
 	}
 	pint, err := strconv.ParseInt(opArr[2], 10, 64)
 	if err != nil {
 		log.Printf("协议错误, %s, %s\n", opArr[2], err)
-		return 0, "", 0, err
+		return 0, "", 0, nil, err
+	}
+	opts, err := analyzeOpts(opArr[3:])
+	if err != nil {
+		log.Printf("协议错误, %s, %s\n", opStr, err)
+		return 0, "", 0, nil, err
+	}
+	return t, opArr[1], pint, opts, nil
+}
+
+// analyzeOpts 解析可选参数，格式：{key}={value}
+func analyzeOpts(optArr []string) (map[string]string, error) {
+	opts := make(map[string]string, len(optArr))
+	for _, opt := range optArr {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("option error: %s", opt)
+		}
+		opts[kv[0]] = kv[1]
 	}
-	return t, opArr[1], pint, nil
+	return opts, nil
 }
 
 // analyzeLogin 用户登陆解析
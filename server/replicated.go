@@ -0,0 +1,607 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReplicaQuorum 写操作至少成功的数据目录数，为0时为多数
+// 组装文件达不到时失败，拆分文件保留，客户端可以重新结束上传；其他写操作达不到时返回错误
+var ReplicaQuorum = 0
+
+// ReplicatedStorage 多个数据目录的副本存储，数据目录应该在不同的磁盘上
+// 上传会话的临时数据保存在第一个数据目录，组装完成后复制到所有数据目录
+// 写操作在所有数据目录上执行，成功的数据目录达到quorum时成功；读操作使用代数最大的副本
+// 每次写入和删除在成功的数据目录中记录文件的代数，见generation
+type ReplicatedStorage struct {
+	replicas []*LocalStorage
+}
+
+// NewReplicatedStorage 创建副本存储，roots为各个数据目录
+func NewReplicatedStorage(roots ...string) *ReplicatedStorage {
+	rs := &ReplicatedStorage{}
+	for _, root := range roots {
+		rs.replicas = append(rs.replicas, NewLocalStorage(root))
+	}
+	return rs
+}
+
+// quorum 返回写操作至少成功的数据目录数
+func (rs *ReplicatedStorage) quorum() int {
+	if ReplicaQuorum > 0 {
+		return min(ReplicaQuorum, len(rs.replicas))
+	}
+	return len(rs.replicas)/2 + 1
+}
+
+// primary 返回保存上传会话临时数据的数据目录
+func (rs *ReplicatedStorage) primary() *LocalStorage {
+	return rs.replicas[0]
+}
+
+// each 在所有数据目录上执行写操作，成功的数据目录达到quorum时返回nil
+// 数据目录中没有这个文件（之前没有写入成功，或者重试时已经完成）时不需要写入，也计入成功
+// 全部失败时返回第一个错误，所有数据目录都没有这个文件时返回不存在的错误
+// 达不到quorum时返回错误，已经写入的数据目录不回滚，读操作按代数使用最新的副本
+func (rs *ReplicatedStorage) each(op, name string, f func(ls *LocalStorage) error) error {
+	var first, absent error
+	ok, missing := 0, 0
+	for _, ls := range rs.replicas {
+		err := f(ls)
+		if err == nil {
+			ok++
+			continue
+		}
+		if os.IsNotExist(err) {
+			missing++
+			absent = err
+			continue
+		}
+		log.Printf("副本写入失败, op:%s, root:%s, name:%s, err:%s\n", op, ls.root, name, err)
+		if first == nil {
+			first = err
+		}
+	}
+	if ok == 0 {
+		if first != nil {
+			return first
+		}
+		return absent
+	}
+	if ok+missing < rs.quorum() {
+		return fmt.Errorf("%s: replicas written %d, quorum %d: %s", op, ok+missing, rs.quorum(), first)
+	}
+	return nil
+}
+
+// pick 返回读操作使用的副本：存在这个文件并且代数最大的数据目录，代数相同时使用修改时间最新的副本
+// 文件或者上级目录在某个数据目录中的删除记录比选中副本的代数大时，文件已被删除，返回不存在的错误
+// 所有数据目录都不能读取时返回第一个错误
+func (rs *ReplicatedStorage) pick(name string) (*LocalStorage, *FileInfo, error) {
+	var src *LocalStorage
+	var info *FileInfo
+	var gen, deleted int64
+	var first error
+	for _, ls := range rs.replicas {
+		deleted = max(deleted, deletedGen(ls, name))
+		fi, err := ls.Stat(name)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		g := liveGen(ls, name)
+		if src == nil || g > gen || (g == gen && fi.ModTime.After(info.ModTime)) {
+			src, info, gen = ls, fi, g
+		}
+	}
+	if src == nil {
+		return nil, nil, first
+	}
+	if deleted > gen {
+		return nil, nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return src, info, nil
+}
+
+// write 在所有数据目录上执行写操作，成功的数据目录记录文件新的代数，见each
+func (rs *ReplicatedStorage) write(op, name string, deleted bool, f func(ls *LocalStorage) error) error {
+	g := generation{gen: newGeneration(), deleted: deleted}
+	return rs.each(op, name, func(ls *LocalStorage) error {
+		if err := f(ls); err != nil {
+			return err
+		}
+		return stamp(ls, name, g)
+	})
+}
+
+// Prepare 在第一个数据目录创建临时文件夹
+func (rs *ReplicatedStorage) Prepare(u *Upload) error {
+	return rs.primary().Prepare(u)
+}
+
+// Offset 返回拆分文件的大小
+func (rs *ReplicatedStorage) Offset(u *Upload, idx int) (int64, error) {
+	return rs.primary().Offset(u, idx)
+}
+
+// Append 打开拆分文件
+func (rs *ReplicatedStorage) Append(u *Upload, idx int) (io.WriteCloser, error) {
+	return rs.primary().Append(u, idx)
+}
+
+// ReadChunk 读取拆分文件
+func (rs *ReplicatedStorage) ReadChunk(u *Upload, idx int) (io.ReadCloser, error) {
+	return rs.primary().ReadChunk(u, idx)
+}
+
+// ResetChunk 删除拆分文件
+func (rs *ReplicatedStorage) ResetChunk(u *Upload, idx int) error {
+	return rs.primary().ResetChunk(u, idx)
+}
+
+// AssembleOverhead 第一个数据目录中拆分文件、组装的文件和复制的隐藏临时文件同时存在，需要额外两份数据的空间
+func (rs *ReplicatedStorage) AssembleOverhead(u *Upload) int64 {
+	return 2 * u.dataSize()
+}
+
+// Assemble 在第一个数据目录的会话文件夹中组装文件，再复制到每个数据目录的隐藏临时文件
+// 复制成功的数据目录达到ReplicaQuorum时提交，否则删除临时文件并返回错误
+// 复制或者提交失败的数据目录没有新的代数，之后通过Repair同步
+func (rs *ReplicatedStorage) Assemble(u *Upload) error {
+	src := rs.primary()
+	staged := filepath.Join(src.dirName(u.ID), "assembled")
+	defer os.Remove(staged)
+	if err := src.assembleTo(u, staged); err != nil {
+		return err
+	}
+	info, err := os.Stat(staged)
+	if err != nil {
+		return err
+	}
+	var outs []*os.File
+	var dsts []*LocalStorage
+	defer func() {
+		for _, out := range outs {
+			removeHidden(out)
+		}
+	}()
+	for _, ls := range rs.replicas {
+		out, err := stageCopy(staged, ls.path(u.Name), info)
+		if err != nil {
+			log.Printf("复制副本失败, root:%s, name:%s, err:%s\n", ls.root, u.Name, err)
+			continue
+		}
+		outs = append(outs, out)
+		dsts = append(dsts, ls)
+	}
+	if len(outs) < rs.quorum() {
+		return fmt.Errorf("replicas written %d, quorum %d", len(outs), rs.quorum())
+	}
+	g := generation{gen: newGeneration()}
+	ok := 0
+	for i, out := range outs {
+		ls := dsts[i]
+		err = commitCopy(out, ls.path(u.Name), info)
+		if err == nil {
+			err = stamp(ls, u.Name, g)
+		}
+		if err != nil {
+			log.Printf("提交副本失败, root:%s, name:%s, err:%s\n", ls.root, u.Name, err)
+			continue
+		}
+		ok++
+	}
+	if ok < rs.quorum() {
+		return fmt.Errorf("replicas committed %d, quorum %d", ok, rs.quorum())
+	}
+	// 合并成功后，删除文件夹和拆分的临时文件
+	if err = src.Abort(u.ID); err != nil {
+		log.Printf("删除文件错误, file name=%s\n", src.dirName(u.ID))
+	}
+	return nil
+}
+
+// Abort 删除所有数据目录中上传会话的临时数据
+func (rs *ReplicatedStorage) Abort(id string) error {
+	return rs.each("abort", id, func(ls *LocalStorage) error {
+		return ls.Abort(id)
+	})
+}
+
+// Temps 列出所有上传会话的临时数据
+func (rs *ReplicatedStorage) Temps() ([]*FileInfo, error) {
+	return rs.primary().Temps()
+}
+
+// ReadTemp 读取上传会话的元数据
+func (rs *ReplicatedStorage) ReadTemp(id, key string) ([]byte, error) {
+	return rs.primary().ReadTemp(id, key)
+}
+
+// WriteTemp 保存上传会话的元数据
+func (rs *ReplicatedStorage) WriteTemp(id, key string, data []byte) error {
+	return rs.primary().WriteTemp(id, key, data)
+}
+
+// Open 从代数最大的副本读取文件
+func (rs *ReplicatedStorage) Open(name string) (io.ReadCloser, error) {
+	ls, _, err := rs.pick(name)
+	if err != nil {
+		return nil, err
+	}
+	return ls.Open(name)
+}
+
+// ReadFile 从代数最大的副本读取文件
+func (rs *ReplicatedStorage) ReadFile(name string) ([]byte, error) {
+	ls, _, err := rs.pick(name)
+	if err != nil {
+		return nil, err
+	}
+	return ls.ReadFile(name)
+}
+
+// WriteFile 在所有数据目录写入文件
+func (rs *ReplicatedStorage) WriteFile(name string, data []byte) error {
+	return rs.write("write", name, false, func(ls *LocalStorage) error {
+		return ls.WriteFile(name, data)
+	})
+}
+
+// Remove 删除所有数据目录中的文件，记录删除的代数
+func (rs *ReplicatedStorage) Remove(name string) error {
+	return rs.write("remove", name, true, func(ls *LocalStorage) error {
+		return ls.Remove(name)
+	})
+}
+
+// Stat 返回代数最大的副本的文件信息
+func (rs *ReplicatedStorage) Stat(name string) (*FileInfo, error) {
+	_, info, err := rs.pick(name)
+	return info, err
+}
+
+// Rename 重命名所有数据目录中的文件，原来的文件名记录删除的代数，目录中文件的代数记录随目录移动
+func (rs *ReplicatedStorage) Rename(oldName, newName string) error {
+	gen := newGeneration()
+	return rs.each("rename", oldName, func(ls *LocalStorage) error {
+		if err := ls.Rename(oldName, newName); err != nil {
+			return err
+		}
+		if err := moveStamps(ls, oldName, newName); err != nil {
+			return err
+		}
+		if err := stamp(ls, oldName, generation{gen: gen, deleted: true}); err != nil {
+			return err
+		}
+		return stamp(ls, newName, generation{gen: gen})
+	})
+}
+
+// SetMeta 设置所有数据目录中文件的元数据
+func (rs *ReplicatedStorage) SetMeta(name string, meta *FileMeta) error {
+	return rs.write("setmeta", name, false, func(ls *LocalStorage) error {
+		return ls.SetMeta(name, meta)
+	})
+}
+
+// Mkdir 在所有数据目录创建目录
+func (rs *ReplicatedStorage) Mkdir(name string) error {
+	return rs.write("mkdir", name, false, func(ls *LocalStorage) error {
+		return ls.Mkdir(name)
+	})
+}
+
+// Free 返回可用空间最小的数据目录的可用空间，每个数据目录都保存完整的数据
+func (rs *ReplicatedStorage) Free() (int64, error) {
+	min := int64(-1)
+	for _, ls := range rs.replicas {
+		free, err := ls.Free()
+		if err != nil {
+			return 0, err
+		}
+		if free >= 0 && (min < 0 || free < min) {
+			min = free
+		}
+	}
+	return min, nil
+}
+
+// List 合并所有数据目录中的文件，同名文件使用代数最大的副本，删除记录比副本的代数大的文件不列出
+func (rs *ReplicatedStorage) List(dir string) ([]*FileInfo, error) {
+	var files []*FileInfo
+	index := make(map[string]int)
+	gens := make(map[string]int64)
+	ok := false
+	var first error
+	for _, ls := range rs.replicas {
+		infos, err := ls.List(dir)
+		if err != nil {
+			log.Printf("副本读取失败, op:list, root:%s, name:%s, err:%s\n", ls.root, dir, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		ok = true
+		for _, info := range infos {
+			gen := liveGen(ls, strings.TrimSuffix(info.Name, "/"))
+			i, found := index[info.Name]
+			if !found {
+				index[info.Name] = len(files)
+				files = append(files, info)
+				gens[info.Name] = gen
+				continue
+			}
+			if gen > gens[info.Name] || (gen == gens[info.Name] && info.ModTime.After(files[i].ModTime)) {
+				files[i] = info
+				gens[info.Name] = gen
+			}
+		}
+	}
+	if !ok {
+		return nil, first
+	}
+	// 删除记录在已经删除了文件的数据目录中
+	var live []*FileInfo
+	for _, info := range files {
+		var deleted int64
+		for _, ls := range rs.replicas {
+			deleted = max(deleted, deletedGen(ls, strings.TrimSuffix(info.Name, "/")))
+		}
+		if deleted <= gens[info.Name] {
+			live = append(live, info)
+		}
+	}
+	return live, nil
+}
+
+// Repair 同步所有数据目录，返回复制和删除的文件个数，用于更换磁盘后恢复数据
+// 每个文件使用代数最大的副本，缺少或者代数更小的副本从它复制；没有代数记录的文件代数为0，代数相同时使用修改时间最新的副本
+// 文件或者上级目录的删除记录比所有副本的代数都大时，删除所有副本；同步后不再需要的删除记录被清理
+// 需要所有数据目录都可以访问，否则删除的文件可能从没有参与同步的数据目录恢复
+func (rs *ReplicatedStorage) Repair() (int, error) {
+	files := make(map[string]map[*LocalStorage]os.FileInfo) // 每个文件在各个数据目录中的副本, key=相对路径（使用/分隔）
+	dirs := make(map[string]bool)
+	gens := make(map[*LocalStorage]map[string]generation)
+	tombs := make(map[string]int64) // 每个名称最大的删除代数
+	lives := make(map[string]int64) // 每个名称最大的写入代数，用于判断目录删除后是否重新创建
+	for _, ls := range rs.replicas {
+		err := filepath.WalkDir(ls.root, func(fn string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && fn == ls.root {
+					// 更换后的空磁盘
+					return filepath.SkipDir
+				}
+				return err
+			}
+			rel, err := filepath.Rel(ls.root, fn)
+			if err != nil || rel == "." {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			// 上传会话的临时数据、代数记录和组装用的隐藏文件不同步
+			if d.IsDir() && (rel == ".sessions" || rel == genDir) {
+				return filepath.SkipDir
+			}
+			if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			if d.IsDir() {
+				dirs[rel] = true
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if files[rel] == nil {
+				files[rel] = make(map[*LocalStorage]os.FileInfo)
+			}
+			files[rel][ls] = info
+			return nil
+		})
+		if err == nil {
+			gens[ls], err = loadGenerations(ls)
+		}
+		if err != nil {
+			log.Printf("遍历数据目录失败, root:%s, err:%s\n", ls.root, err)
+			return 0, err
+		}
+		for rel, g := range gens[ls] {
+			if g.deleted {
+				tombs[rel] = max(tombs[rel], g.gen)
+			} else {
+				lives[rel] = max(lives[rel], g.gen)
+			}
+		}
+	}
+	// deletedAt 名称及上级目录最大的删除代数
+	deletedAt := func(rel string) int64 {
+		gen := tombs[rel]
+		for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+			gen = max(gen, tombs[p])
+		}
+		return gen
+	}
+	// genOf 副本的代数，删除记录之后又写入的文件没有代数
+	genOf := func(ls *LocalStorage, rel string) int64 {
+		if g, ok := gens[ls][rel]; ok && !g.deleted {
+			return g.gen
+		}
+		return 0
+	}
+	num := 0
+	kept := make(map[string]bool)     // 保留的文件的上级目录
+	survived := make(map[string]bool) // 保留的文件
+	for rel, copies := range files {
+		var src *LocalStorage
+		for _, ls := range rs.replicas {
+			info, ok := copies[ls]
+			if !ok {
+				continue
+			}
+			if src == nil || genOf(ls, rel) > genOf(src, rel) ||
+				(genOf(ls, rel) == genOf(src, rel) && info.ModTime().After(copies[src].ModTime())) {
+				src = ls
+			}
+		}
+		gen := genOf(src, rel)
+		if deletedAt(rel) > gen {
+			for ls := range copies {
+				if err := os.Remove(filepath.Join(ls.root, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+					log.Printf("删除副本失败, root:%s, name:%s, err:%s\n", ls.root, rel, err)
+					return num, err
+				}
+				unstamp(ls, rel)
+				log.Printf("删除已删除文件的副本, root:%s, name:%s\n", ls.root, rel)
+				num++
+			}
+			continue
+		}
+		survived[rel] = true
+		for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+			kept[p] = true
+		}
+		info := copies[src]
+		for _, ls := range rs.replicas {
+			if ls == src {
+				continue
+			}
+			if cur, ok := copies[ls]; ok && genOf(ls, rel) == gen && cur.Size() == info.Size() && (gen > 0 || cur.ModTime().Equal(info.ModTime())) {
+				continue
+			}
+			dst := filepath.Join(ls.root, filepath.FromSlash(rel))
+			if err := copyFile(filepath.Join(src.root, filepath.FromSlash(rel)), dst, info); err != nil {
+				log.Printf("修复副本失败, root:%s, name:%s, err:%s\n", ls.root, rel, err)
+				return num, err
+			}
+			if gen > 0 {
+				if err := stamp(ls, rel, generation{gen: gen}); err != nil {
+					return num, err
+				}
+			}
+			log.Printf("修复副本, root:%s, name:%s, from:%s\n", ls.root, rel, src.root)
+			num++
+		}
+	}
+	// 删除的目录从最深的开始删除，只删除空目录
+	var removed []string
+	for rel := range dirs {
+		if !kept[rel] && deletedAt(rel) > lives[rel] {
+			removed = append(removed, rel)
+			continue
+		}
+		for _, ls := range rs.replicas {
+			if err := os.MkdirAll(filepath.Join(ls.root, filepath.FromSlash(rel)), 0777); err != nil {
+				return num, err
+			}
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return len(removed[i]) > len(removed[j]) })
+	for _, rel := range removed {
+		for _, ls := range rs.replicas {
+			if err := os.Remove(filepath.Join(ls.root, filepath.FromSlash(rel))); err == nil {
+				log.Printf("删除已删除目录的副本, root:%s, name:%s\n", ls.root, rel)
+			}
+		}
+	}
+	// 所有副本都已删除的名称不再需要删除记录，保留的文件的删除记录已经被复制时的代数覆盖
+	for ls, recs := range gens {
+		for rel, g := range recs {
+			if !g.deleted || survived[rel] {
+				continue
+			}
+			if err := unstamp(ls, rel); err != nil {
+				log.Printf("清理删除记录失败, root:%s, name:%s, err:%s\n", ls.root, rel, err)
+			}
+		}
+	}
+	return num, nil
+}
+
+// copyFile 复制文件，先写入隐藏的临时文件，落盘后重命名，保留权限、修改时间和空洞
+func copyFile(src, dst string, info os.FileInfo) error {
+	out, err := stageCopy(src, dst, info)
+	if err != nil {
+		return err
+	}
+	defer removeHidden(out)
+	return commitCopy(out, dst, info)
+}
+
+// stageCopy 把文件复制到dst所在目录的隐藏临时文件，保留权限和空洞
+func stageCopy(src, dst string, info os.FileInfo) (*os.File, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return nil, err
+	}
+	out, err := createHidden(dst)
+	if err != nil {
+		return nil, err
+	}
+	if err = copySparse(out, in, info.Size()); err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if err != nil {
+		removeHidden(out)
+		return nil, err
+	}
+	return out, nil
+}
+
+// commitCopy 临时文件落盘后重命名为dst，并设置修改时间
+func commitCopy(out *os.File, dst string, info os.FileInfo) error {
+	if err := commitHidden(out, dst); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copySparse 复制文件数据，全部为0的块跳过不写，保留稀疏文件的空洞
+func copySparse(out *os.File, in io.Reader, size int64) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 文件末尾是空洞时补齐大小
+	return out.Truncate(size)
+}
+
+// isZero 数据是否全部为0
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// RetentionFile 保留规则文件，每行一条规则，为空时不清理已上传的文件
+	RetentionFile = ""
+	// RetentionInterval 执行保留规则的间隔
+	RetentionInterval = time.Hour
+	// RetentionDryRun 只报告保留规则将要删除的文件，不删除
+	RetentionDryRun = false
+)
+
+// retentionRules 从RetentionFile加载的保留规则
+var retentionRules []*retentionRule
+
+// retentionRule 保留规则，作用于目录（包括子目录）中的文件
+// 格式：path={dir} [age={duration}] [keep={n}] [max-size={bytes}]
+// path为相对上传根目录的目录，按用户设置时为用户名，为/时作用于所有用户
+type retentionRule struct {
+	path    string        // 规则作用的目录，为空时表示所有文件
+	age     time.Duration // 上传时间超过age的文件被删除，为0时不限制
+	keep    int           // 只保留最新的keep个文件，为0时不限制
+	maxSize int64         // 文件总大小超过maxSize时从最旧的文件开始删除，为0时不限制
+}
+
+// String 返回规则的文本格式
+func (r *retentionRule) String() string {
+	dir := r.path
+	if dir == "" {
+		dir = "/"
+	}
+	res := "path=" + dir
+	if r.age > 0 {
+		res += " age=" + r.age.String()
+	}
+	if r.keep > 0 {
+		res += " keep=" + strconv.Itoa(r.keep)
+	}
+	if r.maxSize > 0 {
+		res += " max-size=" + strconv.FormatInt(r.maxSize, 10)
+	}
+	return res
+}
+
+// parseRule 解析一条保留规则
+func parseRule(line string) (*retentionRule, error) {
+	opts, err := analyzeOpts(strings.Fields(line))
+	if err != nil {
+		return nil, err
+	}
+	r := &retentionRule{}
+	for key, val := range opts {
+		switch key {
+		case "path":
+			if strings.Trim(val, "/") != "" {
+				if r.path, err = cleanName(val); err != nil {
+					return nil, fmt.Errorf("bad path: %s", val)
+				}
+			}
+			break
+		case "age":
+			if r.age, err = time.ParseDuration(val); err != nil || r.age < 0 {
+				return nil, fmt.Errorf("bad age: %s", val)
+			}
+			break
+		case "keep":
+			if r.keep, err = strconv.Atoi(val); err != nil || r.keep < 0 {
+				return nil, fmt.Errorf("bad keep: %s", val)
+			}
+			break
+		case "max-size":
+			if r.maxSize, err = strconv.ParseInt(val, 10, 64); err != nil || r.maxSize < 0 {
+				return nil, fmt.Errorf("bad max-size: %s", val)
+			}
+			break
+		default:
+			return nil, fmt.Errorf("unknown option: %s", key)
+		}
+	}
+	if _, ok := opts["path"]; !ok {
+		return nil, fmt.Errorf("path required")
+	}
+	if r.age == 0 && r.keep == 0 && r.maxSize == 0 {
+		return nil, fmt.Errorf("age, keep or max-size required")
+	}
+	return r, nil
+}
+
+// loadRetention 从RetentionFile加载保留规则，空行和#开头的行被忽略
+func loadRetention() error {
+	fp, err := os.Open(RetentionFile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var rules []*retentionRule
+	scanner := bufio.NewScanner(fp)
+	for no := 1; scanner.Scan(); no++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", no, err)
+		}
+		rules = append(rules, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	retentionRules = rules
+	return nil
+}
+
+// ruleFile 规则作用的文件
+type ruleFile struct {
+	info     *FileInfo
+	uploaded time.Time // 上传到服务端的时间，见uploadedAt
+}
+
+// expiredFile 保留规则选中需要删除的文件
+type expiredFile struct {
+	*ruleFile
+	reason string // 删除原因：age、keep或者max-size
+}
+
+// selectExpired 返回规则选中的文件，files按上传时间从新到旧排序
+func (r *retentionRule) selectExpired(files []*ruleFile) []*expiredFile {
+	var expired []*expiredFile
+	var kept int
+	var total int64
+	full := false
+	for _, rf := range files {
+		info := rf.info
+		reason := ""
+		switch {
+		case r.age > 0 && time.Since(rf.uploaded) > r.age:
+			reason = "age"
+			break
+		case r.keep > 0 && kept >= r.keep:
+			reason = "keep"
+			break
+		case r.maxSize > 0 && (full || total+info.Size > r.maxSize):
+			// 超过总大小后更旧的文件全部删除
+			full = true
+			reason = "max-size"
+			break
+		}
+		if reason != "" {
+			expired = append(expired, &expiredFile{ruleFile: rf, reason: reason})
+			continue
+		}
+		kept++
+		total += info.Size
+	}
+	return expired
+}
+
+// ruleFiles 列出规则作用的文件，按上传时间从新到旧排序
+// 目录不删除，元数据文件保存在隐藏目录中不会列出，随最终文件一起删除
+func (r *retentionRule) ruleFiles() ([]*ruleFile, error) {
+	infos, err := Store.List(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []*ruleFile
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name, "/") {
+			continue
+		}
+		files = append(files, &ruleFile{info: info, uploaded: uploadedAt(info)})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].uploaded.After(files[j].uploaded)
+	})
+	return files, nil
+}
+
+// retainer 定时执行保留规则
+func retainer() {
+	for {
+		enforceRetention(RetentionDryRun)
+		time.Sleep(RetentionInterval)
+	}
+}
+
+// enforceRetention 执行所有保留规则，返回删除（演练时为将要删除）的文件个数
+// 演练时只在日志中报告将要删除的文件，实际删除时每个文件记录一条审计日志
+func enforceRetention(dryRun bool) int {
+	var num int
+	var size int64
+	for _, r := range retentionRules {
+		files, err := r.ruleFiles()
+		if err != nil {
+			log.Printf("列出保留规则的文件失败, rule:%s, err:%s\n", r, err)
+			continue
+		}
+		for _, ef := range r.selectExpired(files) {
+			info := ef.info
+			if dryRun {
+				log.Printf("保留规则演练, 将删除:%s, reason:%s, size:%d, uploaded:%s, rule:%s\n", info.Name, ef.reason, info.Size, ef.uploaded.Format("2006-01-02 15:04:05"), r)
+				num++
+				size += info.Size
+				continue
+			}
+			if err = deleteFile(info.Name); err != nil {
+				log.Printf("按保留规则删除文件失败, name:%s, err:%s\n", info.Name, err)
+				continue
+			}
+			audit("delete", "-", info.Name, fmt.Sprintf("reason=%s size=%d mtime=%d uploaded=%d rule=%q", ef.reason, info.Size, info.ModTime.Unix(), ef.uploaded.Unix(), r.String()))
+			num++
+			size += info.Size
+		}
+	}
+	if dryRun {
+		log.Printf("保留规则演练完成, 将删除文件个数:%d, 释放:%d字节\n", num, size)
+	} else if num > 0 {
+		log.Printf("按保留规则删除文件, 个数:%d, 释放:%d字节\n", num, size)
+	}
+	return num
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectExpired(t *testing.T) {
+	now := time.Now()
+	// 按上传时间从新到旧排列：f0上传于1小时前，每个文件早1小时
+	files := make([]*ruleFile, 5)
+	for i := range files {
+		size := int64(100 * (i + 1))
+		files[i] = &ruleFile{
+			info:     &FileInfo{Name: fmt.Sprintf("u/f%d", i), Size: size},
+			uploaded: now.Add(-time.Duration(i+1) * time.Hour),
+		}
+	}
+	tests := []struct {
+		rule *retentionRule
+		want string // 选中的文件和原因
+	}{
+		{&retentionRule{age: 10 * time.Hour}, ""},
+		{&retentionRule{age: 150 * time.Minute}, "u/f2:age u/f3:age u/f4:age"},
+		{&retentionRule{keep: 5}, ""},
+		{&retentionRule{keep: 2}, "u/f2:keep u/f3:keep u/f4:keep"},
+		// 100+200+300=600，f3加入后超过700
+		{&retentionRule{maxSize: 700}, "u/f3:max-size u/f4:max-size"},
+		// f0加入后就超过，更旧的文件全部删除，即使f1不超过剩余的空间
+		{&retentionRule{maxSize: 50}, "u/f0:max-size u/f1:max-size u/f2:max-size u/f3:max-size u/f4:max-size"},
+		// 按年龄删除的文件不计入keep和max-size
+		{&retentionRule{age: 210 * time.Minute, keep: 2}, "u/f2:keep u/f3:age u/f4:age"},
+		{&retentionRule{age: 90 * time.Minute, maxSize: 1000}, "u/f1:age u/f2:age u/f3:age u/f4:age"},
+		// 先达到keep的文件按keep删除
+		{&retentionRule{keep: 1, maxSize: 250}, "u/f1:keep u/f2:keep u/f3:keep u/f4:keep"},
+		{&retentionRule{keep: 3, maxSize: 350}, "u/f2:max-size u/f3:max-size u/f4:max-size"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, e := range tt.rule.selectExpired(files) {
+			got = append(got, e.info.Name+":"+e.reason)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: expired = %v, want %s", tt.rule, got, tt.want)
+		}
+	}
+	if expired := (&retentionRule{keep: 1}).selectExpired(nil); len(expired) != 0 {
+		t.Errorf("expired of no files = %v", expired)
+	}
+}
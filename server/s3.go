@@ -0,0 +1,748 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config S3兼容对象存储的配置
+type S3Config struct {
+	Endpoint  string // 服务地址，例如http://127.0.0.1:9000，使用path-style访问
+	Region    string // 区域，例如us-east-1
+	Bucket    string // 桶名称
+	Prefix    string // 对象名前缀
+	AccessKey string // 访问密钥id
+	SecretKey string // 访问密钥
+}
+
+// S3Storage S3兼容对象存储
+// 最终文件保存为{prefix}{name}，拆分文件和会话元数据保存为{prefix}.sessions/{id}/{key}
+// 对象不支持追加写，拆分文件在关闭时与已上传的部分合并后重新上传
+type S3Storage struct {
+	conf   S3Config
+	client *http.Client
+}
+
+// NewS3Storage 创建S3兼容对象存储
+func NewS3Storage(conf S3Config) *S3Storage {
+	conf.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	return &S3Storage{conf: conf, client: &http.Client{Timeout: time.Minute * 10}}
+}
+
+// key 返回文件的对象名
+func (ss *S3Storage) key(name string) string {
+	return ss.conf.Prefix + name
+}
+
+// tempPrefix 返回上传会话临时数据的对象名前缀
+func (ss *S3Storage) tempPrefix(id string) string {
+	return ss.conf.Prefix + ".sessions/" + id + "/"
+}
+
+// tempKey 返回上传会话临时数据的对象名
+func (ss *S3Storage) tempKey(id, key string) string {
+	return ss.tempPrefix(id) + key
+}
+
+// Prepare 对象存储不需要创建文件夹
+func (ss *S3Storage) Prepare(u *Upload) error {
+	return nil
+}
+
+// Offset 返回拆分文件对象的大小
+func (ss *S3Storage) Offset(u *Upload, idx int) (int64, error) {
+	resp, err := ss.do(http.MethodHead, ss.tempKey(u.ID, strconv.Itoa(idx)), nil, nil, -1)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Append 打开拆分文件，写入的数据在关闭时追加到已上传的对象后
+func (ss *S3Storage) Append(u *Upload, idx int) (io.WriteCloser, error) {
+	return &s3Chunk{ss: ss, key: ss.tempKey(u.ID, strconv.Itoa(idx))}, nil
+}
+
+// ReadChunk 读取拆分文件对象
+func (ss *S3Storage) ReadChunk(u *Upload, idx int) (io.ReadCloser, error) {
+	rc, err := ss.get(ss.tempKey(u.ID, strconv.Itoa(idx)))
+	if os.IsNotExist(err) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return rc, err
+}
+
+// ResetChunk 删除拆分文件对象
+func (ss *S3Storage) ResetChunk(u *Upload, idx int) error {
+	return ss.delete(ss.tempKey(u.ID, strconv.Itoa(idx)))
+}
+
+// Assemble 依次读取拆分文件对象，拼接后上传为最终文件
+// 对象不支持空洞，空洞的拆分文件写入0；超过s3PutLimit时分段上传
+func (ss *S3Storage) Assemble(u *Upload) error {
+	if u.Size > s3PutLimit {
+		if err := ss.multipartUpload(ss.key(u.Name), nil, func(id string) ([]s3Part, error) {
+			return ss.uploadParts(u, id)
+		}); err != nil {
+			return err
+		}
+	} else {
+		resp, err := ss.putChunks(u, nil, 0, u.Num, u.Size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return ss.Abort(u.ID)
+}
+
+// putChunks 把序号在[from, to)之间的拆分文件拼接后上传到最终文件的对象，size为拼接后的大小
+// query为分段上传的参数，为nil时上传整个对象
+func (ss *S3Storage) putChunks(u *Upload, query url.Values, from, to int, size int64) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := from; i < to; i++ {
+			if u.Holes[i] {
+				if _, err := io.CopyN(pw, zeros{}, u.chunkSize(i)); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				continue
+			}
+			rc, err := ss.get(ss.tempKey(u.ID, strconv.Itoa(i)))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, rc)
+			rc.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	resp, err := ss.do(http.MethodPut, ss.key(u.Name), query, pr, size)
+	// 上传失败时结束读取拆分文件的协程
+	pr.CloseWithError(io.ErrClosedPipe)
+	return resp, err
+}
+
+// uploadParts 上传组装的文件的每一段，连续的拆分文件合并为一段
+// 每段不小于s3UploadPart，文件较大时增大每段的大小，段数不超过s3MaxParts
+func (ss *S3Storage) uploadParts(u *Upload, id string) ([]s3Part, error) {
+	partSize := max(s3UploadPart, (u.Size+s3MaxParts-1)/s3MaxParts)
+	var parts []s3Part
+	for from := 0; from < u.Num; {
+		to, size := from, int64(0)
+		for to < u.Num && size < partSize {
+			size += u.chunkSize(to)
+			to++
+		}
+		num := len(parts) + 1
+		resp, err := ss.putChunks(u, url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {id}}, from, to, size)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: num, ETag: resp.Header.Get("ETag")})
+		from = to
+	}
+	return parts, nil
+}
+
+// Abort 删除上传会话的所有临时对象
+func (ss *S3Storage) Abort(id string) error {
+	objs, err := ss.list(ss.tempPrefix(id))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err = ss.delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Temps 列出所有上传会话的临时对象，按会话id汇总
+func (ss *S3Storage) Temps() ([]*FileInfo, error) {
+	prefix := ss.conf.Prefix + ".sessions/"
+	objs, err := ss.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var temps []*FileInfo
+	index := make(map[string]*FileInfo)
+	for _, obj := range objs {
+		id := strings.SplitN(strings.TrimPrefix(obj.Key, prefix), "/", 2)[0]
+		info, ok := index[id]
+		if !ok {
+			info = &FileInfo{Name: id}
+			index[id] = info
+			temps = append(temps, info)
+		}
+		info.Size += obj.Size
+		if obj.LastModified.After(info.ModTime) {
+			info.ModTime = obj.LastModified
+		}
+	}
+	return temps, nil
+}
+
+// ReadTemp 读取上传会话的元数据
+func (ss *S3Storage) ReadTemp(id, key string) ([]byte, error) {
+	return ss.read(ss.tempKey(id, key))
+}
+
+// WriteTemp 保存上传会话的元数据
+func (ss *S3Storage) WriteTemp(id, key string, data []byte) error {
+	return ss.put(ss.tempKey(id, key), data)
+}
+
+// Open 读取最终文件
+func (ss *S3Storage) Open(name string) (io.ReadCloser, error) {
+	return ss.get(ss.key(name))
+}
+
+// ReadFile 读取文件
+func (ss *S3Storage) ReadFile(name string) ([]byte, error) {
+	return ss.read(ss.key(name))
+}
+
+// WriteFile 写入文件
+func (ss *S3Storage) WriteFile(name string, data []byte) error {
+	return ss.put(ss.key(name), data)
+}
+
+// Remove 删除文件
+func (ss *S3Storage) Remove(name string) error {
+	return ss.delete(ss.key(name))
+}
+
+// Stat 返回对象的信息，name不是对象但有前缀为name/的对象时按目录返回，大小为0
+func (ss *S3Storage) Stat(name string) (*FileInfo, error) {
+	resp, err := ss.do(http.MethodHead, ss.key(name), nil, nil, -1)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if ok, lerr := ss.hasPrefix(ss.key(name) + "/"); lerr != nil {
+				return nil, lerr
+			} else if ok {
+				return &FileInfo{Name: name}, nil
+			}
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	// 上传时保存的源文件修改时间
+	if ns, err := strconv.ParseInt(resp.Header.Get("x-amz-meta-mtime"), 10, 64); err == nil {
+		mtime = time.Unix(0, ns)
+	}
+	return &FileInfo{Name: name, Size: resp.ContentLength, ModTime: mtime}, nil
+}
+
+// Rename 对象存储不支持重命名，复制后删除原对象
+// oldName不是对象时按目录重命名，逐个复制并删除前缀为oldName/的所有对象，包括Mkdir创建的目录对象
+func (ss *S3Storage) Rename(oldName, newName string) error {
+	err := ss.copyObject(ss.key(oldName), ss.key(newName), nil)
+	if err == nil {
+		return ss.delete(ss.key(oldName))
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	prefix := ss.key(oldName) + "/"
+	objs, err := ss.list(prefix)
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return notExist("rename", oldName)
+	}
+	for _, obj := range objs {
+		dst := ss.key(newName) + "/" + strings.TrimPrefix(obj.Key, prefix)
+		if err = ss.copyObject(obj.Key, dst, nil); err != nil {
+			return err
+		}
+		if err = ss.delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMeta 对象存储不能修改已有对象的元数据，复制到自身并替换用户元数据
+// 保存为x-amz-meta-mtime、x-amz-meta-mode、x-amz-meta-xattr
+func (ss *S3Storage) SetMeta(name string, meta *FileMeta) error {
+	header := http.Header{}
+	if !meta.ModTime.IsZero() {
+		header.Set("x-amz-meta-mtime", strconv.FormatInt(meta.ModTime.UnixNano(), 10))
+	}
+	if meta.Mode != 0 {
+		header.Set("x-amz-meta-mode", strconv.FormatUint(uint64(meta.Mode), 8))
+	}
+	if len(meta.Xattrs) > 0 {
+		header.Set("x-amz-meta-xattr", encodeXattrs(meta.Xattrs))
+	}
+	return ss.copyObject(ss.key(name), ss.key(name), header)
+}
+
+var (
+	// s3CopyLimit 一次CopyObject可以复制的最大对象大小，更大的对象使用分段复制
+	s3CopyLimit int64 = 5 << 30
+	// s3CopyPart 分段复制时每段的大小
+	s3CopyPart int64 = 512 << 20
+	// s3PutLimit 一次PutObject可以上传的最大对象大小，组装更大的文件使用分段上传
+	s3PutLimit int64 = 5 << 30
+	// s3UploadPart 分段上传组装的文件时每段的最小大小
+	s3UploadPart int64 = 64 << 20
+	// s3MaxParts 一次分段上传最多的段数
+	s3MaxParts int64 = 10000
+)
+
+// copyObject 在桶内复制对象，meta不为nil时替换用户元数据，否则保留原对象的用户元数据
+// 对象超过s3CopyLimit时使用UploadPartCopy分段复制
+func (ss *S3Storage) copyObject(src, dst string, meta http.Header) error {
+	resp, err := ss.do(http.MethodHead, src, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	source := s3Escape("/"+ss.conf.Bucket+"/"+src, false)
+	if resp.ContentLength <= s3CopyLimit {
+		header := http.Header{"x-amz-copy-source": {source}}
+		if meta != nil {
+			header.Set("x-amz-metadata-directive", "REPLACE")
+			for k, v := range meta {
+				header[k] = v
+			}
+		}
+		resp, err = ss.doHeader(http.MethodPut, dst, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	// 分段复制不会复制原对象的用户元数据
+	if meta == nil {
+		meta = http.Header{}
+		for k, v := range resp.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+				meta[k] = v
+			}
+		}
+	}
+	return ss.multipartUpload(dst, meta, func(id string) ([]s3Part, error) {
+		return ss.copyParts(source, dst, id, resp.ContentLength)
+	})
+}
+
+// s3Part 分段上传中的一段
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipartUpload 创建分段上传，upload上传每一段后完成分段上传，失败时取消分段上传
+// meta为对象的用户元数据
+func (ss *S3Storage) multipartUpload(dst string, meta http.Header, upload func(id string) ([]s3Part, error)) error {
+	resp, err := ss.send(http.MethodPost, dst, url.Values{"uploads": {""}}, meta, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initRes struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initRes)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	parts, err := upload(initRes.UploadID)
+	if err == nil {
+		err = ss.completeMultipart(dst, initRes.UploadID, parts)
+	}
+	if err != nil {
+		if resp, aerr := ss.do(http.MethodDelete, dst, url.Values{"uploadId": {initRes.UploadID}}, nil, -1); aerr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// copyParts 按s3CopyPart分段复制对象，返回复制的每一段
+func (ss *S3Storage) copyParts(source, dst, id string, size int64) ([]s3Part, error) {
+	var parts []s3Part
+	for off := int64(0); off < size; off += s3CopyPart {
+		num := len(parts) + 1
+		header := http.Header{
+			"x-amz-copy-source":       {source},
+			"x-amz-copy-source-range": {fmt.Sprintf("bytes=%d-%d", off, min(off+s3CopyPart, size)-1)},
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {id}}
+		resp, err := ss.send(http.MethodPut, dst, query, header, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			ETag string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, s3Part{PartNumber: num, ETag: res.ETag})
+	}
+	return parts, nil
+}
+
+// completeMultipart 按段号完成分段上传
+func (ss *S3Storage) completeMultipart(dst, id string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := ss.do(http.MethodPost, dst, url.Values{"uploadId": {id}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 完成分段上传失败时也可能返回200，错误在响应体中
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(msg, []byte("<Error>")) {
+		return &s3Error{method: http.MethodPost, key: dst, status: resp.StatusCode, body: string(msg)}
+	}
+	return nil
+}
+
+// Mkdir 对象存储没有目录，创建以/结尾的空对象作为目录标记
+func (ss *S3Storage) Mkdir(name string) error {
+	return ss.put(ss.key(name)+"/", nil)
+}
+
+// Free 对象存储不限制空间
+func (ss *S3Storage) Free() (int64, error) {
+	return -1, nil
+}
+
+// List 按前缀列出对象，Mkdir创建的目录对象以/结尾
+// ModTime为对象的最后修改时间，不读取上传时保存的源文件修改时间
+func (ss *S3Storage) List(dir string) ([]*FileInfo, error) {
+	prefix := ss.key(dir)
+	if dir != "" {
+		prefix += "/"
+	}
+	objs, err := ss.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var files []*FileInfo
+	for _, obj := range objs {
+		name := strings.TrimPrefix(obj.Key, ss.conf.Prefix)
+		// 前缀本身是目录对象
+		if obj.Key == prefix || !listed(strings.TrimSuffix(name, "/")) {
+			continue
+		}
+		files = append(files, &FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return files, nil
+}
+
+// get 下载对象
+func (ss *S3Storage) get(key string) (io.ReadCloser, error) {
+	resp, err := ss.do(http.MethodGet, key, nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// read 下载整个对象
+func (ss *S3Storage) read(key string) ([]byte, error) {
+	rc, err := ss.get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// put 上传对象
+func (ss *S3Storage) put(key string, data []byte) error {
+	resp, err := ss.do(http.MethodPut, key, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// delete 删除对象，对象不存在时不返回错误
+func (ss *S3Storage) delete(key string) error {
+	resp, err := ss.do(http.MethodDelete, key, nil, nil, -1)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Object ListObjectsV2返回的对象信息
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// listResult ListObjectsV2的返回结果
+type listResult struct {
+	Contents              []s3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list 列出前缀为prefix的所有对象
+func (ss *S3Storage) list(prefix string) ([]s3Object, error) {
+	var objs []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := ss.do(http.MethodGet, "", query, nil, -1)
+		if err != nil {
+			return nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, res.Contents...)
+		if !res.IsTruncated {
+			return objs, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// hasPrefix 返回是否有前缀为prefix的对象
+func (ss *S3Storage) hasPrefix(prefix string) (bool, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {"1"}}
+	resp, err := ss.do(http.MethodGet, "", query, nil, -1)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var res listResult
+	if err = xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return false, err
+	}
+	return len(res.Contents) > 0, nil
+}
+
+// s3Error 对象存储返回的错误
+type s3Error struct {
+	method string
+	key    string
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 %s %s: %d %s", e.method, e.key, e.status, e.body)
+}
+
+// do 发送签名后的请求，size为-1时没有请求体
+func (ss *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	return ss.send(method, key, query, nil, body, size)
+}
+
+// doHeader 发送带有额外请求头的签名请求，没有请求体
+func (ss *S3Storage) doHeader(method, key string, header http.Header) (*http.Response, error) {
+	return ss.send(method, key, nil, header, nil, 0)
+}
+
+// send 发送签名后的请求
+func (ss *S3Storage) send(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(ss.conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + ss.conf.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	ss.sign(req, time.Now().UTC())
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, notExist(strings.ToLower(method), key)
+		}
+		return nil, &s3Error{method: method, key: key, status: resp.StatusCode, body: string(msg)}
+	}
+	return resp, nil
+}
+
+// sign 使用AWS Signature Version 4签名请求，请求体不参与签名
+func (ss *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	ss.signAt(req, amzDate, date)
+}
+
+// signAt 计算签名并设置Authorization头
+func (ss *S3Storage) signAt(req *http.Request, amzDate, date string) {
+	// 规范请求头
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "host" || lk == "content-type" || lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	// 规范查询参数
+	query := req.URL.Query()
+	qkeys := make([]string, 0, len(query))
+	for k := range query {
+		qkeys = append(qkeys, k)
+	}
+	sort.Strings(qkeys)
+	var qs []string
+	for _, k := range qkeys {
+		for _, v := range query[k] {
+			qs = append(qs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(qs, "&"),
+		canonHeaders.String(),
+		signed,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	scope := date + "/" + ss.conf.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+ss.conf.SecretKey), date)
+	key = hmacSHA256(key, ss.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		ss.conf.AccessKey, scope, signed, sig))
+}
+
+// hmacSHA256 计算HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape 按照SigV4的规则编码，path为false时保留/
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// s3Chunk 对象存储中的拆分文件
+type s3Chunk struct {
+	ss  *S3Storage
+	key string
+	buf bytes.Buffer // 本次写入的数据
+}
+
+// Write 缓存写入的数据
+func (sc *s3Chunk) Write(p []byte) (int, error) {
+	return sc.buf.Write(p)
+}
+
+// Close 与已上传的部分合并后重新上传
+func (sc *s3Chunk) Close() error {
+	if sc.buf.Len() == 0 {
+		return nil
+	}
+	old, err := sc.ss.read(sc.key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return sc.ss.put(sc.key, append(old, sc.buf.Bytes()...))
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -17,6 +19,26 @@ func init() {
 // Start 服务端启动方法
 func Start() {
 	log.Println("服务器启动中")
+	if KeyFile != "" {
+		if err := loadMasterKey(); err != nil {
+			log.Fatalf("加载静态加密主密钥错误 %s, %s\n", KeyFile, err)
+		}
+		log.Println("已开启静态加密")
+	}
+	if !validConflict(ConflictPolicy) {
+		log.Fatalf("冲突策略错误, %s\n", ConflictPolicy)
+	}
+	if SessionTTL > 0 {
+		log.Printf("已开启过期上传会话清理, ttl:%s\n", SessionTTL)
+		go janitor()
+	}
+	if RetentionFile != "" {
+		if err := loadRetention(); err != nil {
+			log.Fatalf("加载保留规则错误 %s, %s\n", RetentionFile, err)
+		}
+		log.Printf("已开启保留规则, 规则个数:%d, 间隔:%s, 演练:%t\n", len(retentionRules), RetentionInterval, RetentionDryRun)
+		go retainer()
+	}
 	l, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("端口监听错误 %s, %s\n", port, err)
@@ -43,53 +65,172 @@ func serverDeal(conn net.Conn) {
 		return
 	}
 	writeBufferTimeOut(conn, []byte("success"))
-	buf, n, err := readBufferTimeOut(conn)
+	opStr, err := readOp(conn)
 	if err != nil {
 		return
 	}
-	opStr := string(buf[:n])
-	opType, pstr, pint, err := analyzeOp(opStr)
+	opType, pstr, pint, opts, err := analyzeOp(opStr)
 	if err != nil {
 		return
 	}
 	switch opType {
 	case bigType:
 		// 上传大文件
-		// 文件名格式错误
-		if strings.HasSuffix(pstr, "/") {
-			log.Printf("文件名格式错误,name:%s\n", pstr)
+		var fs = &fileServer{
+			usr:      usr,
+			conn:     conn,
+			size:     pint,
+			fn:       pstr,
+			compress: chooseCompress(opts["compress"]),
+			enc:      opts["enc"],
+			conflict: opts["conflict"],
+			sum:      opts["sha256"],
+			uid:      opts["session"],
+			source:   opts["source"],
+		}
+		// 空文件没有拆分文件，结束上传时生成空的文件
+		if fs.size < 0 {
+			log.Printf("文件大小错误, size:%d\n", fs.size)
 			return
 		}
-		var fs = &fileServer{
-			usr:  usr,
-			conn: conn,
-			size: pint,
-			fn:   pstr,
+		if fs.conflict == "" {
+			fs.conflict = ConflictPolicy
+		}
+		if !validConflict(fs.conflict) {
+			log.Printf("冲突策略错误, conflict:%s\n", fs.conflict)
+			return
+		}
+		if fs.holes, err = parseHoles(opts["holes"], fs.size); err != nil {
+			log.Printf("文件空洞错误, err:%s\n", err)
+			return
+		}
+		if !fs.sparse() {
+			fs.holes = nil
+		}
+		if fs.meta, err = parseMeta(opts); err != nil {
+			log.Printf("文件元数据错误, err:%s\n", err)
+			return
+		}
+		if !validSource(fs.source) {
+			log.Printf("源文件指纹错误, source:%s\n", fs.source)
+			return
+		}
+		if fs.enc != "" {
+			// 密文不可压缩
+			fs.compress = noCompress
+			if fs.overhead, err = strconv.ParseInt(opts["overhead"], 10, 64); err != nil || fs.overhead < 0 {
+				log.Printf("加密参数错误, overhead:%s\n", opts["overhead"])
+				return
+			}
 		}
 		fs.receive()
 		break
 	case splitType:
-		// 验证用户是否正确
-		if !strings.HasPrefix(pstr, usr.name+"_") {
+		// 会话id格式错误
+		if !validID(pstr) {
 			writeBufferTimeOut(conn, []byte("用户非法"))
-			log.Printf("用户非法,usr:%s\n", usr.name)
+			log.Printf("会话id非法,usr:%s, uid:%s\n", usr.name, pstr)
 			return
 		}
 		// 上传拆分的文件
 		var sfs = &singleFileServer{
+			usr:     usr,
 			conn:    conn,
 			uid:     pstr,
 			idx:     int(pint),
 			allowed: true,
+			done:    make(chan struct{}),
 		}
 		sfs.reveive()
 		break
+	case endType:
+		// 服务端重启或者主连接断开后结束上传
+		endSession(conn, usr, pstr)
+		break
+	case statusType:
+		// 服务端重启或者主连接断开后查询上传会话的状态
+		if !validID(pstr) {
+			writeBufferTimeOut(conn, []byte("fail\n"))
+			return
+		}
+		statusSession(conn, usr, pstr, opts["hash"] == "1")
+		break
+	case versionsType, restoreType, fetchType:
+		fn, err := userPath(usr, pstr)
+		if err != nil {
+			log.Printf("文件名不合法, usr:%s, fn:%s\n", usr.name, pstr)
+			writeBufferTimeOut(conn, []byte("badpath\n"))
+			return
+		}
+		versionDeal(conn, usr, opType, fn, pint)
+		break
+	case getType, partType:
+		fn, err := userPath(usr, pstr)
+		if err != nil {
+			log.Printf("文件名不合法, usr:%s, fn:%s\n", usr.name, pstr)
+			writeBufferTimeOut(conn, []byte("badpath\n"))
+			return
+		}
+		if opType == getType {
+			sendScheme(conn, fn)
+			return
+		}
+		off, err := strconv.ParseInt(opts["offset"], 10, 64)
+		if opts["offset"] == "" {
+			off, err = 0, nil
+		}
+		if err != nil || off < 0 {
+			log.Printf("下载偏移错误, usr:%s, fn:%s, offset:%s\n", usr.name, fn, opts["offset"])
+			writeBufferTimeOut(conn, []byte("fail\n"))
+			return
+		}
+		sendPart(conn, fn, pint, off)
+		break
+	case listType, statType, deleteType, moveType:
+		manageDeal(conn, usr, opType, pstr, opts)
+		break
+	case mkdirType:
+		// 创建目录，目录上传时创建空目录
+		fn, err := userPath(usr, pstr)
+		if err != nil {
+			log.Printf("目录名不合法, usr:%s, dir:%s\n", usr.name, pstr)
+			writeBufferTimeOut(conn, []byte("badpath\n"))
+			return
+		}
+		if err = Store.Mkdir(fn); err != nil {
+			log.Printf("创建目录失败, usr:%s, dir:%s, err:%s\n", usr.name, fn, err)
+			writeBufferTimeOut(conn, []byte("fail"))
+			return
+		}
+		audit("mkdir", usr.name, fn, "")
+		writeBufferTimeOut(conn, []byte("success"))
+		break
 	default:
 		log.Printf("操作类型错误, %d\n", opType)
 		return
 	}
 }
 
+// versionDeal 处理历史版本的查询、恢复和下载
+func versionDeal(conn net.Conn, usr *user, opType int, fn string, pint int64) {
+	switch opType {
+	case versionsType:
+		sendVersions(conn, fn)
+		break
+	case restoreType:
+		if err := restoreVersion(fn, int(pint)); err != nil {
+			log.Printf("恢复历史版本失败, usr:%s, fn:%s, id:%d, err:%s\n", usr.name, fn, pint, err)
+			writeBufferTimeOut(conn, []byte("fail"))
+			return
+		}
+		writeBufferTimeOut(conn, []byte("success"))
+		break
+	case fetchType:
+		sendVersion(conn, fn, int(pint))
+		break
+	}
+}
+
 // userVerify 用户验证，成功返回用户
 func clientVerify(conn net.Conn) (*user, bool) {
 	buf, n, err := readBufferTimeOut(conn)
@@ -123,6 +264,39 @@ func readBuffer(conn net.Conn) ([]byte, int, error) {
 	return buf, n, nil
 }
 
+// maxOpLen 分帧发送的操作请求的最大长度
+const maxOpLen = 64 * 1024
+
+// readOp 读取客户端的操作请求
+// 超过一次读取长度的请求由客户端分帧发送：先发送一行请求的字节数{n}，然后发送n个字节
+func readOp(conn net.Conn) (string, error) {
+	buf, n, err := readBufferTimeOut(conn)
+	if err != nil {
+		return "", err
+	}
+	head := string(buf[:n])
+	i := strings.IndexByte(head, '\n')
+	if i <= 0 {
+		return head, nil
+	}
+	size, err := strconv.Atoi(head[:i])
+	if err != nil {
+		// 操作名开头，不是分帧的请求
+		return head, nil
+	}
+	if size < 0 || size > maxOpLen || n-i-1 > size {
+		log.Printf("请求长度错误, size:%d\n", size)
+		return "", fmt.Errorf("protocol error")
+	}
+	op := make([]byte, size)
+	k := copy(op, buf[i+1:n])
+	if _, err = io.ReadFull(conn, op[k:]); err != nil {
+		log.Printf("读取请求错误, size:%d, err:%s\n", size, err)
+		return "", err
+	}
+	return string(op), nil
+}
+
 // writeBufferTimeOut 写数据到缓冲区，过期两秒
 func writeBufferTimeOut(conn net.Conn, content []byte) error {
 	// conn.SetWriteDeadline(time.Now().Add(time.Second * 2))
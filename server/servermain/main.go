@@ -1,9 +1,70 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"os"
 	"songxh/file_transport/server"
+	"strings"
 )
 
 func main() {
+	var storage, root, replicas string
+	var repair bool
+	var s3conf server.S3Config
+	flag.StringVar(&server.KeyFile, "key", "", "静态加密主密钥文件，内容为32字节密钥的hex编码，为空时不加密")
+	flag.IntVar(&server.VersionKeep, "versions", 0, "上传同名文件时保留的历史版本个数")
+	flag.DurationVar(&server.VersionMaxAge, "version-age", 0, "历史版本的最长保留时间，例如720h")
+	flag.StringVar(&server.ConflictPolicy, "conflict", "overwrite", "客户端没有指定时，已存在同名文件的处理策略：overwrite、rename、skip、reject")
+	flag.DurationVar(&server.SessionTTL, "session-ttl", server.SessionTTL, "未完成的上传会话空闲超过这个时间后删除临时数据，为0时不清理")
+	flag.DurationVar(&server.GCInterval, "gc-interval", server.GCInterval, "检查过期上传会话的间隔")
+	flag.Int64Var(&server.DiskReserve, "disk-reserve", 0, "存储需要保留的可用空间（字节），可用空间不足时拒绝新的上传")
+	flag.StringVar(&server.RetentionFile, "retention", "", "保留规则文件，每行一条规则：path={dir} [age={duration}] [keep={n}] [max-size={bytes}]，为空时不清理已上传的文件")
+	flag.DurationVar(&server.RetentionInterval, "retention-interval", server.RetentionInterval, "执行保留规则的间隔")
+	flag.BoolVar(&server.RetentionDryRun, "retention-dry-run", false, "只在日志中报告保留规则将要删除的文件，不删除")
+	flag.StringVar(&server.AuditFile, "audit", "", "审计日志文件，记录按保留规则删除等操作，为空时只写入服务日志")
+	flag.StringVar(&storage, "storage", "local", "存储后端：local、prealloc、mem、s3、replicated")
+	flag.StringVar(&root, "root", "./upload", "local和prealloc存储的上传根目录，相对路径按启动目录转换为绝对路径")
+	flag.StringVar(&replicas, "replicas", "", "replicated存储的数据目录，逗号分隔，每个目录保存完整的数据，应该在不同的磁盘上")
+	flag.IntVar(&server.ReplicaQuorum, "replica-quorum", 0, "replicated存储写操作至少成功的数据目录数，为0时为多数")
+	flag.BoolVar(&repair, "repair", false, "同步replicated存储的所有数据目录后退出，用于更换磁盘后恢复数据")
+	flag.StringVar(&s3conf.Endpoint, "s3-endpoint", "http://127.0.0.1:9000", "S3兼容对象存储地址")
+	flag.StringVar(&s3conf.Region, "s3-region", "us-east-1", "S3区域")
+	flag.StringVar(&s3conf.Bucket, "s3-bucket", "upload", "S3桶名称")
+	flag.StringVar(&s3conf.Prefix, "s3-prefix", "", "S3对象名前缀")
+	flag.Parse()
+	switch storage {
+	case "local":
+		server.Store = server.NewLocalStorage(root)
+	case "prealloc":
+		server.Store = server.NewPreallocStorage(root)
+	case "mem":
+		server.Store = server.NewMemStorage()
+	case "s3":
+		// 访问密钥从环境变量读取，避免出现在进程参数中
+		s3conf.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3conf.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		server.Store = server.NewS3Storage(s3conf)
+	case "replicated":
+		roots := strings.Split(replicas, ",")
+		if len(roots) < 2 {
+			log.Fatalf("replicated存储至少需要两个数据目录, replicas:%s\n", replicas)
+		}
+		server.Store = server.NewReplicatedStorage(roots...)
+	default:
+		log.Fatalf("存储后端错误, %s\n", storage)
+	}
+	if repair {
+		rs, ok := server.Store.(*server.ReplicatedStorage)
+		if !ok {
+			log.Fatalf("只有replicated存储支持repair, storage:%s\n", storage)
+		}
+		num, err := rs.Repair()
+		if err != nil {
+			log.Fatalf("同步数据目录失败, err:%s\n", err)
+		}
+		log.Printf("同步数据目录完成, 复制和删除的文件个数:%d\n", num)
+		return
+	}
 	server.Start()
 }
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sessionKey 上传会话记录在临时存储中的名称
+// 服务端重启后根据会话记录恢复上传，拆分文件的进度由存储记录（Offset）
+const sessionKey = "session"
+
+// sessionIDLen 上传会话id的字节数，hex编码后发送给客户端
+const sessionIDLen = 16
+
+// newSessionID 生成随机的上传会话id
+func newSessionID() (string, error) {
+	b := make([]byte, sessionIDLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID 会话id格式是否正确，会话id作为临时存储的路径使用，不能包含其他字符
+func validID(id string) bool {
+	if len(id) != sessionIDLen*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// saveSession 保存上传会话记录
+// 格式：uid={uid} user={user} name={file.name} size={file_size} chunk={chunk_size} num={n} compress={name} conflict={policy} [orig={file.name}] [enc={meta} overhead={n}] [holes={...}] [source={fingerprint} [changed={fingerprint}]] [mtime={unix_nano}] [mode={octal}] [xattr={...}]
+// 冲突重命名时orig为客户端请求的文件名
+// 源文件变化后客户端校验拆分文件之前，source保留之前的指纹，changed为新的指纹
+func (fs *fileServer) saveSession() error {
+	rec := fmt.Sprintf("uid=%s user=%s name=%s size=%d chunk=%d num=%d compress=%s conflict=%s",
+		fs.uid, fs.usr.name, fs.fn, fs.size, singleMaxSize, fs.num, fs.compress, fs.conflict)
+	if fs.orig != "" && fs.orig != fs.fn {
+		rec += " orig=" + fs.orig
+	}
+	if fs.enc != "" {
+		rec += fmt.Sprintf(" enc=%s overhead=%d", fs.enc, fs.overhead)
+	}
+	if len(fs.holes) > 0 {
+		rec += " holes=" + encodeHoles(fs.holes)
+	}
+	if fs.source != "" {
+		rec += " source=" + fs.source
+	}
+	if fs.changed != "" {
+		rec += " changed=" + fs.changed
+	}
+	if fs.meta != nil && fs.meta.String() != "" {
+		rec += " " + fs.meta.String()
+	}
+	return Store.WriteTemp(fs.uid, sessionKey, []byte(rec))
+}
+
+// restoreSession 根据会话记录恢复上传会话，恢复的会话没有主连接
+func restoreSession(usr *user, uid string) (*fileServer, error) {
+	if !validID(uid) {
+		return nil, fmt.Errorf("invalid session id")
+	}
+	b, err := Store.ReadTemp(uid, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := analyzeOpts(strings.Fields(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	if rec["uid"] != uid || rec["user"] != usr.name {
+		return nil, fmt.Errorf("session mismatch: %s", rec["uid"])
+	}
+	fn, orig := rec["name"], rec["orig"]
+	if orig == "" {
+		orig = fn
+	}
+	if !strings.HasPrefix(fn, usr.name+"/") || !strings.HasPrefix(orig, usr.name+"/") {
+		return nil, fmt.Errorf("session name mismatch: %s", fn)
+	}
+	// 拆分大小变化后已上传的拆分文件不能再使用
+	if rec["chunk"] != strconv.FormatInt(singleMaxSize, 10) {
+		return nil, fmt.Errorf("chunk size changed: %s", rec["chunk"])
+	}
+	fs := &fileServer{
+		usr:      usr,
+		uid:      uid,
+		fn:       fn,
+		orig:     orig,
+		compress: rec["compress"],
+		conflict: rec["conflict"],
+		enc:      rec["enc"],
+		source:   rec["source"],
+		changed:  rec["changed"],
+	}
+	if fs.size, err = strconv.ParseInt(rec["size"], 10, 64); err != nil {
+		return nil, err
+	}
+	if fs.enc != "" {
+		if fs.overhead, err = strconv.ParseInt(rec["overhead"], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if fs.holes, err = parseHoles(rec["holes"], fs.size); err != nil {
+		return nil, err
+	}
+	if fs.meta, err = parseMeta(rec); err != nil {
+		return nil, err
+	}
+	fs.calSplitNum()
+	if strconv.Itoa(fs.num) != rec["num"] {
+		return nil, fmt.Errorf("chunk num mismatch: %s", rec["num"])
+	}
+	// 静态加密的数据密钥
+	ok, err := fs.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("data key mismatch")
+	}
+	return fs, nil
+}
+
+// getSession 返回用户正在进行的上传会话，不存在时根据会话记录恢复
+func getSession(usr *user, uid string) (*fileServer, bool) {
+	if fs, ok := allfsGet(uid); ok {
+		if fs.usr.name != usr.name {
+			log.Printf("上传会话不属于用户, uid:%s, usr:%s\n", uid, usr.name)
+			return nil, false
+		}
+		return fs, true
+	}
+	fs, err := restoreSession(usr, uid)
+	if err != nil {
+		log.Printf("恢复上传会话失败, uid:%s, err:%s\n", uid, err)
+		return nil, false
+	}
+	// 恢复的会话已经写入了部分数据，不检查可用空间
+	fs.reserve(false)
+	if !allfsAdd(fs) {
+		// 其他连接已经恢复了这个会话
+		return getSession(usr, uid)
+	}
+	log.Printf("恢复上传会话, uid:%s, fn:%s, size:%d\n", uid, fs.fn, fs.size)
+	return fs, true
+}
+
+// endSession 在新的连接上结束没有主连接的上传会话
+// 服务端重启或者主连接断开后，客户端重新连接发送end
+func endSession(conn net.Conn, usr *user, uid string) {
+	fs, ok := getSession(usr, uid)
+	if !ok {
+		writeBufferTimeOut(conn, []byte(sessionFail(uid)))
+		return
+	}
+	if fs.conn != nil {
+		log.Printf("上传会话的主连接仍然有效, uid:%s\n", uid)
+		writeBufferTimeOut(conn, []byte("fail"))
+		return
+	}
+	res := fs.finish()
+	fs.stopAll()
+	writeBufferTimeOut(conn, []byte(res))
+}
+
+// detached 是否是没有主连接并且没有正在接收的拆分文件的会话
+func (fs *fileServer) detached() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.conn != nil {
+		return false
+	}
+	for _, sfs := range fs.split {
+		if sfs != nil && !sfs.finished() {
+			return false
+		}
+	}
+	return true
+}
+
+// resume 客户端指定会话id时恢复这个会话，文件名使用会话记录中的文件名
+// 会话不存在或者与这次上传不一致时返回false，重新创建会话
+func (fs *fileServer) resume(uid string) bool {
+	rfs, err := restoreSession(fs.usr, uid)
+	if err != nil {
+		log.Printf("恢复上传会话失败, uid:%s, err:%s\n", uid, err)
+		return false
+	}
+	if rfs.size != fs.size || (rfs.enc == "") != (fs.enc == "") {
+		log.Printf("上传会话与这次上传不一致, uid:%s, size:%d/%d\n", uid, rfs.size, fs.size)
+		return false
+	}
+	fs.renamed = path.Base(rfs.fn) != path.Base(fs.fn)
+	fs.uid, fs.fn, fs.orig, fs.conflict = uid, rfs.fn, rfs.orig, rfs.conflict
+	fs.checkSource(rfs)
+	log.Printf("客户端恢复上传会话, uid:%s, fn:%s\n", fs.uid, fs.fn)
+	return true
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSession 创建并保存一个上传会话，写入第一个拆分文件的部分数据
+func newTestSession(t *testing.T, usr *user) *fileServer {
+	t.Helper()
+	id, err := newSessionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fileServer{
+		usr:      usr,
+		uid:      id,
+		fn:       "client/dir/a(2).bin",
+		orig:     "client/dir/a.bin",
+		size:     3*singleMaxSize + 10,
+		compress: "deflate",
+		conflict: "rename",
+		enc:      "aes-gcm:1000:00:01020304:",
+		overhead: 16,
+		holes:    []extent{{off: singleMaxSize, size: singleMaxSize}},
+		source:   "100-200",
+		changed:  "100-300",
+		meta:     &FileMeta{ModTime: time.Unix(0, 1234567890), Mode: 0640, Xattrs: map[string][]byte{"user.tag": []byte("v")}},
+	}
+	fs.calSplitNum()
+	u := &Upload{ID: fs.uid, Name: fs.fn, Size: fs.size, Chunk: singleMaxSize, Num: fs.num}
+	if err = Store.Prepare(u); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.saveKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Store.Append(u, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("12345"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestRestoreSession(t *testing.T) {
+	oldStore, oldKey := Store, masterKey
+	defer func() { Store, masterKey = oldStore, oldKey }()
+	for _, atRest := range []bool{false, true} {
+		Store, masterKey = NewMemStorage(), nil
+		if atRest {
+			masterKey = make([]byte, 32)
+			rand.Read(masterKey)
+		}
+		usr := &user{name: "client"}
+		fs := newTestSession(t, usr)
+		// 服务端重启后内存中的会话丢失，根据会话记录恢复
+		got, err := restoreSession(usr, fs.uid)
+		if err != nil {
+			t.Fatalf("at rest %t: %s", atRest, err)
+		}
+		if got.fn != fs.fn || got.orig != fs.orig || got.size != fs.size || got.num != fs.num ||
+			got.compress != fs.compress || got.conflict != fs.conflict || got.enc != fs.enc || got.overhead != fs.overhead ||
+			got.source != fs.source || got.changed != fs.changed {
+			t.Fatalf("at rest %t: restored %+v, want %+v", atRest, got, fs)
+		}
+		if !reflect.DeepEqual(got.holes, fs.holes) || !reflect.DeepEqual(got.holeIdx, fs.holeIdx) || !reflect.DeepEqual(got.meta, fs.meta) {
+			t.Fatalf("at rest %t: restored holes %v %v meta %+v", atRest, got.holes, got.holeIdx, got.meta)
+		}
+		if !reflect.DeepEqual(got.dk, fs.dk) {
+			t.Fatalf("at rest %t: restored data key %v, want %v", atRest, got.dk, fs.dk)
+		}
+		// 拆分文件的进度由存储记录
+		u := &Upload{ID: got.uid, Name: got.fn, Size: got.size, Chunk: singleMaxSize, Num: got.num}
+		if off, err := Store.Offset(u, 0); err != nil || off != 5 {
+			t.Fatalf("at rest %t: offset = %d, %v", atRest, off, err)
+		}
+		// 静态加密配置变化后已上传的拆分文件不能再使用
+		if atRest {
+			masterKey = nil
+		} else {
+			masterKey = make([]byte, 32)
+		}
+		if _, err = restoreSession(usr, fs.uid); err == nil {
+			t.Fatalf("at rest %t: restored after master key changed", atRest)
+		}
+	}
+}
+
+func TestRestoreSessionMismatch(t *testing.T) {
+	oldStore, oldKey := Store, masterKey
+	defer func() { Store, masterKey = oldStore, oldKey }()
+	Store, masterKey = NewMemStorage(), nil
+	usr := &user{name: "client"}
+	fs := newTestSession(t, usr)
+	rec, _ := Store.ReadTemp(fs.uid, sessionKey)
+	if _, err := restoreSession(&user{name: "other"}, fs.uid); err == nil {
+		t.Fatalf("restored other user's session")
+	}
+	if _, err := restoreSession(usr, "../"+fs.uid[3:]); err == nil {
+		t.Fatalf("restored invalid session id")
+	}
+	other, _ := newSessionID()
+	if _, err := restoreSession(usr, other); err == nil {
+		t.Fatalf("restored missing session")
+	}
+	// 会话记录被修改时不恢复
+	for _, repl := range [][2]string{
+		{"name=client/", "name=other/"},
+		{"orig=client/", "orig=other/"},
+		{"chunk=1024", "chunk=2048"},
+		{"num=4", "num=5"},
+		{"holes=1024+1024", "holes=1024+9999"},
+		{"uid=" + fs.uid, "uid=" + other},
+	} {
+		if !strings.Contains(string(rec), repl[0]) {
+			t.Fatalf("record %q has no %q", rec, repl[0])
+		}
+		Store.WriteTemp(fs.uid, sessionKey, []byte(strings.Replace(string(rec), repl[0], repl[1], 1)))
+		if _, err := restoreSession(usr, fs.uid); err == nil {
+			t.Errorf("restored session with %s", repl[1])
+		}
+	}
+}
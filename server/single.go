@@ -6,21 +6,24 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"time"
 )
 
 type singleFileServer struct {
-	conn    net.Conn    // 连接
-	uid     string      // 唯一id
-	idx     int         // 分拆序号
-	size    int64       // 该文件的大小
-	fn      string      // 本地文件名
-	allowed bool        // 是否允许上传
-	fs      *fileServer // 总的文件服务
+	usr     *user         // 用户
+	conn    net.Conn      // 连接
+	uid     string        // 唯一id
+	idx     int           // 分拆序号
+	size    int64         // 该文件的大小
+	allowed bool          // 是否允许上传
+	done    chan struct{} // 接收结束，数据已经写入存储
+	fs      *fileServer   // 总的文件服务
 }
 
 // receive 接收单个文件
 func (sfs *singleFileServer) reveive() {
-	fs, ok := allfsGet(sfs.uid)
+	defer close(sfs.done)
+	fs, ok := getSession(sfs.usr, sfs.uid)
 	if !ok {
 		log.Printf("获取总文件服务失败,uid:%s\n", sfs.uid)
 		return
@@ -31,52 +34,63 @@ func (sfs *singleFileServer) reveive() {
 		return
 	}
 	sfs.fs = fs
-	sfs.setName()
 	sfs.setSize()
 	sfs.receiveFile()
 }
 
-// setName 设置拆分文件在本地存储的文件名
-func (sfs *singleFileServer) setName() {
-	sfs.fn = sfs.fs.singlefilename(sfs.idx)
-}
-
-// setSize 设置文件的大小
+// setSize 设置文件的大小，端到端加密时为密文大小
 func (sfs *singleFileServer) setSize() {
-	// 最后一个index
-	if sfs.idx == sfs.fs.num-1 {
-		sfs.size = sfs.fs.size - singleMaxSize*int64(sfs.idx)
-	} else {
-		sfs.size = singleMaxSize
-	}
+	sfs.size = sfs.fs.upload().chunkSize(sfs.idx)
 }
 
 // receiveFile 接收文件
 func (sfs *singleFileServer) receiveFile() {
-	// 打开文件，不存在时创建，存在时追加写
-	fp, err := os.OpenFile(sfs.fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0766)
+	u := sfs.fs.upload()
+	size, err := Store.Offset(u, sfs.idx)
 	if err != nil {
-		log.Printf("打开文件失败, %s\n", err)
+		log.Printf("获取续传位置失败, uid:%s, idx:%d, err:%s\n", sfs.uid, sfs.idx, err)
 		writeBufferTimeOut(sfs.conn, []byte("server exception"))
 		return
 	}
-	defer fp.Close()
-	size, err := getFileSize(sfs.fn)
+	// 打开拆分文件，写入的数据追加在续传位置之后
+	fp, err := Store.Append(u, sfs.idx)
 	if err != nil {
+		log.Printf("打开文件失败, %s\n", err)
 		writeBufferTimeOut(sfs.conn, []byte("server exception"))
 		return
 	}
+	defer func() {
+		if err := fp.Close(); err != nil {
+			log.Printf("保存拆分文件失败, uid:%s, idx:%d, err:%s\n", sfs.uid, sfs.idx, err)
+		}
+	}()
 	// 回复客户端断点续传位置
 	err = writeBufferTimeOut(sfs.conn, []byte(strconv.FormatInt(size, 10)))
 	if err != nil {
 		return
 	}
-	var buf []byte
+	// 静态加密时按照在最终文件中的偏移加密后写入
+	var dst io.Writer = fp
+	if sfs.fs.dk != nil {
+		off := int64(sfs.idx)*(singleMaxSize+sfs.fs.overhead) + size
+		if dst, err = sfs.fs.dk.writer(fp, off); err != nil {
+			log.Printf("创建加密流失败, uid:%s, idx:%d, err:%s\n", sfs.uid, sfs.idx, err)
+			return
+		}
+	}
+	// 按照协商的算法解压缩客户端发送的数据
+	src, err := decompressReader(sfs.fs.compress, sfs.conn)
+	if err != nil {
+		log.Printf("创建解压缩流失败, uid:%s, idx:%d, err:%s\n", sfs.uid, sfs.idx, err)
+		return
+	}
+	defer src.Close()
+	buf := make([]byte, 1000)
 	var n int
 	// 从buffer中读取数据，写入文件
 	for sfs.allowed && size < sfs.size {
-		buf, n, err = readBufferTimeOut(sfs.conn)
-		if err != nil {
+		n, err = src.Read(buf)
+		if n == 0 && err != nil {
 			if err == io.EOF {
 				log.Println("拆分文件上传读取EOF!")
 				break
@@ -84,10 +98,10 @@ func (sfs *singleFileServer) receiveFile() {
 			log.Printf("拆分文件上传读取错误, %s\n", err)
 			return
 		}
-		if len(buf) == 0 {
+		if n == 0 {
 			continue
 		}
-		_, err = fp.Write(buf[:n])
+		_, err = dst.Write(buf[:n])
 		if err != nil {
 			log.Printf("拆分文件上传写入文件错误, %s\n", err)
 			writeBufferTimeOut(sfs.conn, []byte("server exception"))
@@ -116,3 +130,24 @@ func getFileSize(fn string) (int64, error) {
 func (sfs *singleFileServer) stop() {
 	sfs.allowed = false
 }
+
+// finished 接收是否已经结束
+func (sfs *singleFileServer) finished() bool {
+	select {
+	case <-sfs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait 等待接收结束，数据写入存储后才能校验拆分文件的大小
+func (sfs *singleFileServer) wait(timeout time.Duration) bool {
+	select {
+	case <-sfs.done:
+		return true
+	case <-time.After(timeout):
+		log.Printf("等待拆分文件接收结束超时, uid:%s, idx:%d\n", sfs.uid, sfs.idx)
+		return false
+	}
+}
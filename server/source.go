@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// maxSourceLen 源文件指纹的最大长度（hex编码）
+const maxSourceLen = 64
+
+// validSource 源文件指纹格式是否正确，为空时表示客户端不检查源文件变化
+func validSource(source string) bool {
+	if len(source) > maxSourceLen {
+		return false
+	}
+	_, err := hex.DecodeString(source)
+	return err == nil
+}
+
+// checkSource 续传时比较源文件指纹与会话记录
+// 源文件变化后已上传的拆分文件可能是旧的内容，记录新的指纹，回复客户端changed=1
+// 客户端按sha256校验拆分文件并清空不一致的拆分文件后，新的指纹替换会话记录中的指纹
+func (fs *fileServer) checkSource(rfs *fileServer) {
+	if fs.source == "" {
+		// 客户端没有提供指纹时保留会话记录
+		fs.source, fs.changed = rfs.source, rfs.changed
+		return
+	}
+	if rfs.source == "" || (rfs.source == fs.source && rfs.changed == "") {
+		return
+	}
+	log.Printf("源文件已变化，需要校验已上传的拆分文件, uid:%s, source:%s/%s\n", fs.uid, rfs.source, fs.source)
+	fs.source, fs.changed = rfs.source, fs.source
+}
+
+// reset 清空客户端校验不一致的拆分文件，返回回复客户端的结果
+// idxs为逗号分隔的拆分文件序号，done为true时校验结束，新的指纹写入会话记录
+func (fs *fileServer) reset(idxs string, done bool) string {
+	u := fs.upload()
+	var list []int
+	for _, s := range strings.Split(idxs, ",") {
+		if s == "" {
+			continue
+		}
+		idx, err := strconv.Atoi(s)
+		if err != nil || idx < 0 || idx >= fs.num {
+			log.Printf("拆分文件序号错误, uid:%s, idx:%s\n", fs.uid, s)
+			return "fail"
+		}
+		list = append(list, idx)
+	}
+	if err := fs.resetChunks(u, list); err != nil {
+		log.Printf("清空拆分文件失败, uid:%s, err:%s\n", fs.uid, err)
+		return "fail"
+	}
+	if len(list) > 0 {
+		log.Printf("清空源文件变化的拆分文件, uid:%s, num:%d\n", fs.uid, len(list))
+	}
+	if !done || fs.changed == "" {
+		return "success"
+	}
+	// 与清理过期会话互斥
+	unlock := lockName(fs.uid)
+	defer unlock()
+	source, changed := fs.source, fs.changed
+	fs.source, fs.changed = changed, ""
+	if err := fs.saveSession(); err != nil {
+		log.Printf("保存会话记录失败, uid:%s, err:%s\n", fs.uid, err)
+		fs.source, fs.changed = source, changed
+		return "fail"
+	}
+	log.Printf("源文件校验完成, uid:%s, source:%s\n", fs.uid, fs.source)
+	return "success"
+}
+
+// resetChunks 清空拆分文件，正在接收的拆分文件不能清空
+func (fs *fileServer) resetChunks(u *Upload, list []int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, idx := range list {
+		if sfs := fs.split[idx]; sfs != nil {
+			if !sfs.finished() {
+				return fmt.Errorf("chunk %d receiving", idx)
+			}
+			fs.split[idx] = nil
+		}
+		if err := Store.ResetChunk(u, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
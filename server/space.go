@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// DiskReserve 存储需要保留的可用空间（字节），可用空间不足时拒绝新的上传
+var DiskReserve int64 = 0
+
+// errNoSpace 存储空间不足，回复客户端nospace
+var errNoSpace = fmt.Errorf("insufficient storage")
+
+var (
+	spaceMu      sync.Mutex
+	reserved     int64                    // 所有上传会话预留的空间
+	reservations = make(map[string]int64) // 每个上传会话预留的空间，key=uid
+)
+
+// assembleOverhead 组装时临时需要额外空间的存储
+// 返回组装过程中与拆分文件同时存在的数据大小，没有实现时为0
+type assembleOverhead interface {
+	AssembleOverhead(u *Upload) int64
+}
+
+// dataSize 返回上传会话需要写入的数据大小，空洞不占用空间
+func (u *Upload) dataSize() int64 {
+	size := u.Size
+	for idx := range u.Holes {
+		size -= u.chunkSize(idx)
+	}
+	return size
+}
+
+// need 返回上传会话需要的空间，包括组装时的额外空间
+func (fs *fileServer) need() int64 {
+	u := fs.upload()
+	need := u.dataSize()
+	if ao, ok := Store.(assembleOverhead); ok {
+		need += ao.AssembleOverhead(u)
+	}
+	return need
+}
+
+// reserve 为上传会话预留空间，文件组装完成或者临时数据被删除时释放，主连接断开后保留
+// check为true时检查存储的可用空间，已经写入或者预分配的临时数据已经从可用空间中扣除
+// 每个会话只计算预留空间中还没有写入的部分，可用空间减去其他会话还需要的空间和DiskReserve后不足时返回errNoSpace
+func (fs *fileServer) reserve(check bool) error {
+	need := fs.need()
+	spaceMu.Lock()
+	defer spaceMu.Unlock()
+	if check {
+		free, err := Store.Free()
+		if err != nil {
+			return err
+		}
+		if free >= 0 {
+			used, err := tempUsage()
+			if err != nil {
+				return err
+			}
+			var others int64
+			for uid, n := range reservations {
+				if uid != fs.uid {
+					others += max(0, n-used[uid])
+				}
+			}
+			remain := max(0, need-used[fs.uid])
+			if free-others-DiskReserve < remain {
+				log.Printf("存储空间不足, fn:%s, need:%d, written:%d, free:%d, reserved:%d, keep:%d\n", fs.fn, need, used[fs.uid], free, others, DiskReserve)
+				return errNoSpace
+			}
+		}
+	}
+	reserved += need - reservations[fs.uid]
+	reservations[fs.uid] = need
+	return nil
+}
+
+// tempUsage 返回每个上传会话已经写入或者预分配的临时数据大小，key=uid
+func tempUsage() (map[string]int64, error) {
+	temps, err := Store.Temps()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]int64)
+	for _, temp := range temps {
+		used[temp.Name] = temp.Size
+	}
+	return used, nil
+}
+
+// release 释放上传会话预留的空间
+func release(uid string) {
+	spaceMu.Lock()
+	defer spaceMu.Unlock()
+	reserved -= reservations[uid]
+	delete(reservations, uid)
+}
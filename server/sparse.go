@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// extent 文件中的一段连续区域
+type extent struct {
+	off  int64 // 起始偏移
+	size int64 // 长度
+}
+
+// parseHoles 解析客户端文件的空洞
+// 协议：holes={off}+{len},...，按偏移排序，不能重叠，不能超出文件大小
+func parseHoles(str string, size int64) ([]extent, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var holes []extent
+	var end int64
+	for _, s := range strings.Split(str, ",") {
+		pair := strings.SplitN(s, "+", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("holes error: %s", s)
+		}
+		off, err := strconv.ParseInt(pair[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("holes error: %s", s)
+		}
+		n, err := strconv.ParseInt(pair[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("holes error: %s", s)
+		}
+		// 比较n和size-off，避免off+n溢出
+		if off < end || n <= 0 || n > size-off {
+			return nil, fmt.Errorf("holes out of range: %s", s)
+		}
+		holes = append(holes, extent{off: off, size: n})
+		end = off + n
+	}
+	return holes, nil
+}
+
+// encodeHoles 编码文件的空洞：{off}+{len},...
+func encodeHoles(holes []extent) string {
+	strs := make([]string, 0, len(holes))
+	for _, h := range holes {
+		strs = append(strs, fmt.Sprintf("%d+%d", h.off, h.size))
+	}
+	return strings.Join(strs, ",")
+}
+
+// sparse 是否接受客户端的空洞
+// 端到端加密和静态加密时空洞的密文不是0，拆分文件都需要上传
+func (fs *fileServer) sparse() bool {
+	return fs.enc == "" && masterKey == nil
+}
+
+// markHoles 标记全部在空洞中的拆分文件，这些拆分文件不上传，组装时生成空洞
+func (fs *fileServer) markHoles() {
+	fs.holeIdx = nil
+	if len(fs.holes) == 0 {
+		return
+	}
+	u := &Upload{Size: fs.size, Chunk: singleMaxSize, Num: fs.num}
+	idx := make(map[int]bool)
+	for _, h := range fs.holes {
+		// 第一个起始位置在空洞中的拆分文件
+		for i := int((h.off + singleMaxSize - 1) / singleMaxSize); i < fs.num; i++ {
+			start := int64(i) * singleMaxSize
+			if start+u.chunkSize(i) > h.off+h.size {
+				break
+			}
+			idx[i] = true
+		}
+	}
+	if len(idx) > 0 {
+		fs.holeIdx = idx
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHoles(t *testing.T) {
+	tests := []struct {
+		str  string
+		size int64
+		want []extent
+		ok   bool
+	}{
+		{"", 100, nil, true},
+		{"0+10", 100, []extent{{0, 10}}, true},
+		{"0+10,20+80", 100, []extent{{0, 10}, {20, 80}}, true},
+		// 相邻的空洞
+		{"0+10,10+10", 100, []extent{{0, 10}, {10, 10}}, true},
+		{"0+100", 100, []extent{{0, 100}}, true},
+		// 格式错误
+		{"10", 100, nil, false},
+		{"a+10", 100, nil, false},
+		{"10+b", 100, nil, false},
+		{"0+10,", 100, nil, false},
+		{"0-10", 100, nil, false},
+		// 长度不是正数
+		{"0+0", 100, nil, false},
+		{"0+-5", 100, nil, false},
+		{"-5+10", 100, nil, false},
+		// 重叠或者没有按偏移排序
+		{"0+10,5+10", 100, nil, false},
+		{"20+10,0+10", 100, nil, false},
+		// 超出文件大小
+		{"90+11", 100, nil, false},
+		{"101+1", 100, nil, false},
+		{"1+9223372036854775807", 100, nil, false},
+		{"9223372036854775807+1", 100, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseHoles(tt.str, tt.size)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHoles(%q, %d) = %v, %v, want %v", tt.str, tt.size, got, err, tt.want)
+			continue
+		}
+		// 编码后解析得到相同的空洞
+		if tt.ok && tt.str != "" && encodeHoles(got) != tt.str {
+			t.Errorf("encodeHoles(%v) = %q, want %q", got, encodeHoles(got), tt.str)
+		}
+	}
+}
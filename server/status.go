@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// status 返回每个拆分文件已接收的字节数，hash为true时附带已接收完整的拆分文件的sha256
+// 格式：每个拆分文件一行：{idx} {received} [{sha256}]，空洞的拆分文件不需要上传，已接收的字节数为拆分文件的大小
+// sha256按客户端发送的数据计算（解压缩后，端到端加密时为密文），静态加密的拆分文件解密后计算
+func (fs *fileServer) status(hash bool) (string, error) {
+	u := fs.upload()
+	var b strings.Builder
+	for i := 0; i < u.Num; i++ {
+		if u.Holes[i] {
+			fmt.Fprintf(&b, "%d %d\n", i, u.chunkSize(i))
+			continue
+		}
+		size, err := Store.Offset(u, i)
+		if err != nil {
+			return "", err
+		}
+		if !hash || size != u.chunkSize(i) {
+			fmt.Fprintf(&b, "%d %d\n", i, size)
+			continue
+		}
+		sum, err := fs.chunkSum(u, i)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%d %d %s\n", i, size, sum)
+	}
+	return b.String(), nil
+}
+
+// chunkSum 计算拆分文件的sha256
+func (fs *fileServer) chunkSum(u *Upload, idx int) (string, error) {
+	rc, err := Store.ReadChunk(u, idx)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	var src io.Reader = rc
+	if fs.dk != nil {
+		s, err := fs.dk.stream(int64(idx) * u.Chunk)
+		if err != nil {
+			return "", err
+		}
+		src = cipherReader(s, rc)
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, src); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// sendStatus 回复客户端上传会话的状态
+// 协议：先发送一行状态的字节数{n}，失败时为fail，然后发送n个字节的状态
+func (fs *fileServer) sendStatus(conn net.Conn, hash bool) {
+	res, err := fs.status(hash)
+	if err != nil {
+		log.Printf("查询上传会话状态失败, uid:%s, err:%s\n", fs.uid, err)
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return
+	}
+	writeBufferTimeOut(conn, []byte(fmt.Sprintf("%d\n%s", len(res), res)))
+}
+
+// statusSession 在新的连接上查询上传会话的状态
+// 服务端重启或者主连接断开后，客户端重新连接发送status
+func statusSession(conn net.Conn, usr *user, uid string, hash bool) {
+	fs, ok := getSession(usr, uid)
+	if !ok {
+		writeBufferTimeOut(conn, []byte(sessionFail(uid)+"\n"))
+		return
+	}
+	fs.sendStatus(conn, hash)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Upload 上传会话在存储中的拆分方案
+type Upload struct {
+	ID    string       // 上传会话id，拆分文件和会话元数据按会话id保存
+	Name  string       // 最终文件相对上传根目录的路径，使用/分隔
+	Size  int64        // 最终文件保存的大小
+	Chunk int64        // 单个拆分文件的大小，最后一个拆分文件可能更小
+	Num   int          // 拆分文件个数
+	Holes map[int]bool // 全部为空洞的拆分文件序号，不上传，组装时生成空洞或者写入0
+}
+
+// chunkSize 返回第idx个拆分文件的大小
+func (u *Upload) chunkSize(idx int) int64 {
+	if idx == u.Num-1 {
+		return u.Size - u.Chunk*int64(idx)
+	}
+	return u.Chunk
+}
+
+// zeros 读取时返回0的Reader，用于不支持空洞的存储写入空洞
+type zeros struct{}
+
+// Read 填充0
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// FileInfo 存储中文件的信息
+type FileInfo struct {
+	Name    string    // 文件名
+	Size    int64     // 文件大小
+	ModTime time.Time // 修改时间
+}
+
+// FileMeta 客户端源文件的元数据，组装完成后设置到最终文件
+type FileMeta struct {
+	ModTime time.Time         // 修改时间，为零值时保留组装时间
+	Mode    os.FileMode       // 权限位，为0时保留存储的默认权限
+	Xattrs  map[string][]byte // 扩展属性
+}
+
+// Storage 文件存储后端
+// 上传过程中拆分文件和会话元数据按会话id保存在临时存储中，组装完成后生成最终文件
+// 同一个文件可以同时有多个上传会话
+// 读取不存在的数据时返回的错误满足os.IsNotExist
+type Storage interface {
+	// Prepare 创建上传会话的临时存储，已存在时保留已上传的数据用于续传
+	Prepare(u *Upload) error
+	// Offset 返回拆分文件已经写入的字节数，即续传位置
+	Offset(u *Upload, idx int) (int64, error)
+	// Append 打开拆分文件，写入的数据追加在续传位置之后，关闭时数据写入完成
+	Append(u *Upload, idx int) (io.WriteCloser, error)
+	// ReadChunk 读取拆分文件已经写入的数据，拆分文件不存在时返回空的数据
+	ReadChunk(u *Upload, idx int) (io.ReadCloser, error)
+	// ResetChunk 清空拆分文件已经写入的数据，之后从头重新上传
+	ResetChunk(u *Upload, idx int) error
+	// Assemble 按序号拼接所有拆分文件生成最终文件，并删除临时存储
+	Assemble(u *Upload) error
+	// Abort 删除上传会话的临时存储
+	Abort(id string) error
+	// Temps 列出所有上传会话的临时存储，Name为会话id，Size为临时数据的总大小，ModTime为最后写入时间
+	Temps() ([]*FileInfo, error)
+	// ReadTemp 读取上传会话的元数据
+	ReadTemp(id, key string) ([]byte, error)
+	// WriteTemp 保存上传会话的元数据
+	WriteTemp(id, key string, data []byte) error
+	// Open 读取最终文件
+	Open(name string) (io.ReadCloser, error)
+	// ReadFile 读取整个文件，用于最终文件旁边保存的元数据
+	ReadFile(name string) ([]byte, error)
+	// WriteFile 写入整个文件，用于最终文件旁边保存的元数据
+	WriteFile(name string, data []byte) error
+	// Remove 删除文件，文件不存在时不返回错误
+	Remove(name string) error
+	// Stat 返回文件的信息
+	Stat(name string) (*FileInfo, error)
+	// Rename 重命名文件，newName已存在时被替换
+	Rename(oldName, newName string) error
+	// SetMeta 设置最终文件的元数据，存储不支持的元数据被忽略
+	SetMeta(name string, meta *FileMeta) error
+	// Mkdir 创建目录以及所有上级目录，已存在时不返回错误
+	Mkdir(name string) error
+	// Free 返回存储的可用空间（字节），不限制时返回-1
+	Free() (int64, error)
+	// List 列出目录（包括子目录）中的所有最终文件和目录，Name为相对上传根目录的路径，dir为空时列出所有文件
+	// 目录的Name以/结尾，不包括上传会话、历史版本、元数据文件和组装用的隐藏文件，目录不存在时返回空列表
+	List(dir string) ([]*FileInfo, error)
+}
+
+// Store 服务端使用的存储后端
+var Store Storage = NewLocalStorage("./upload")
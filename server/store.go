@@ -22,7 +22,26 @@ func allfsGet(uid string) (*fileServer, bool) {
 	return val.(*fileServer), true
 }
 
-// allfsDelete 删除uid对应的file server
-func allfsDelete(uid string) {
-	allfs.Delete(uid)
+// allfsAttach 存储有主连接的file server
+// 已存在没有主连接的会话（服务端重启后恢复的会话）时替换，返回true
+func allfsAttach(fs *fileServer) bool {
+	for {
+		val, loaded := allfs.LoadOrStore(fs.uid, fs)
+		if !loaded {
+			return true
+		}
+		old := val.(*fileServer)
+		if !old.detached() {
+			return false
+		}
+		if allfs.CompareAndSwap(fs.uid, old, fs) {
+			return true
+		}
+	}
+}
+
+// allfsDelete 删除file server，已经被替换时不删除
+// 会话预留的存储空间在文件组装完成或者临时数据被删除时释放
+func allfsDelete(fs *fileServer) {
+	allfs.CompareAndDelete(fs.uid, fs)
 }
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// VersionKeep 上传同名文件时保留的历史版本个数，为0时不按个数清理
+	VersionKeep = 0
+	// VersionMaxAge 历史版本的最长保留时间，为0时不按时间清理
+	// VersionKeep和VersionMaxAge都为0时不保留历史版本，上传同名文件直接覆盖
+	VersionMaxAge time.Duration
+)
+
+// metaDir 保存最终文件的元数据文件的隐藏目录，与.versions相同保留在每一级目录中
+const metaDir = ".meta"
+
+// 最终文件的元数据文件后缀，随文件一起归档和恢复，见metaName
+var sidecars = []string{".enc", ".key", uploadedExt}
+
+// metaName 返回文件的元数据文件名：{dir}/.meta/{file.name}{ext}
+func metaName(name, ext string) string {
+	return path.Join(path.Dir(name), metaDir, path.Base(name)+ext)
+}
+
+// nameLocks 文件名锁，保证同一个文件的提交、归档和恢复不会同时进行，见lockFile
+var nameLocks sync.Map
+
+// lockName 锁定文件名，返回解锁函数
+func lockName(name string) func() {
+	val, _ := nameLocks.LoadOrStore(name, &sync.Mutex{})
+	mu := val.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// version 文件的一个版本
+type version struct {
+	id      int       // 版本号，从1开始递增
+	time    time.Time // 上传完成时间
+	session string    // 产生这个版本的上传会话
+	size    int64     // 文件大小
+}
+
+// String 返回版本的协议格式：id={id} time={unix} session={uid} size={size}
+func (v *version) String() string {
+	return fmt.Sprintf("id=%d time=%d session=%s size=%d", v.id, v.time.Unix(), v.session, v.size)
+}
+
+// versioning 是否保留历史版本
+func versioning() bool {
+	return VersionKeep > 0 || VersionMaxAge > 0
+}
+
+// versionDir 返回文件的历史版本目录：{dir}/.versions/{file.name}
+func versionDir(name string) string {
+	return path.Join(path.Dir(name), ".versions", path.Base(name))
+}
+
+// versionName 返回历史版本的文件名
+func versionName(name string, id int) string {
+	return path.Join(versionDir(name), strconv.Itoa(id))
+}
+
+// loadVersions 读取文件的版本记录，最后一条记录是当前版本
+func loadVersions(name string) ([]*version, error) {
+	b, err := Store.ReadFile(path.Join(versionDir(name), "index"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var vers []*version
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		opts, err := analyzeOpts(strings.Fields(line))
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(opts["id"])
+		if err != nil {
+			return nil, err
+		}
+		unix, _ := strconv.ParseInt(opts["time"], 10, 64)
+		size, _ := strconv.ParseInt(opts["size"], 10, 64)
+		vers = append(vers, &version{id: id, time: time.Unix(unix, 0), session: opts["session"], size: size})
+	}
+	return vers, nil
+}
+
+// saveVersions 保存文件的版本记录
+func saveVersions(name string, vers []*version) error {
+	var b strings.Builder
+	for _, v := range vers {
+		b.WriteString(v.String() + "\n")
+	}
+	return Store.WriteFile(path.Join(versionDir(name), "index"), []byte(b.String()))
+}
+
+// moveFile 移动文件和它的元数据文件
+// 先移动元数据文件再移动文件，失败时把已经移动的元数据文件移回，移动后的文件不会没有对应的密钥
+func moveFile(from, to string) error {
+	var moved []string
+	rollback := func() {
+		for _, ext := range moved {
+			if err := Store.Rename(metaName(to, ext), metaName(from, ext)); err != nil {
+				log.Printf("恢复元数据文件失败, from:%s, to:%s, err:%s\n", metaName(to, ext), metaName(from, ext), err)
+			}
+		}
+	}
+	for _, ext := range sidecars {
+		if err := Store.Rename(metaName(from, ext), metaName(to, ext)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			rollback()
+			return err
+		}
+		moved = append(moved, ext)
+	}
+	if err := Store.Rename(from, to); err != nil {
+		rollback()
+		return err
+	}
+	return nil
+}
+
+// removeFile 删除文件和它的元数据文件
+func removeFile(name string) error {
+	for _, ext := range sidecars {
+		if err := Store.Remove(metaName(name, ext)); err != nil {
+			return err
+		}
+	}
+	return Store.Remove(name)
+}
+
+// deleteFile 删除文件，同时删除元数据文件和所有历史版本
+func deleteFile(name string) error {
+	unlock, err := lockFile(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	vers, err := loadVersions(name)
+	if err != nil {
+		return err
+	}
+	for i, v := range vers {
+		if i == len(vers)-1 {
+			break
+		}
+		if err = removeFile(versionName(name, v.id)); err != nil {
+			return err
+		}
+	}
+	if len(vers) > 0 {
+		if err = Store.Remove(path.Join(versionDir(name), "index")); err != nil {
+			return err
+		}
+	}
+	return removeFile(name)
+}
+
+// addVersion 记录新的当前版本，并清理过期的历史版本
+func addVersion(name string, vers []*version, session string, size int64) error {
+	if !versioning() {
+		return nil
+	}
+	id := 1
+	if len(vers) > 0 {
+		id = vers[len(vers)-1].id + 1
+	}
+	vers = append(vers, &version{id: id, time: time.Now(), session: session, size: size})
+	return saveVersions(name, pruneVersions(name, vers))
+}
+
+// pruneVersions 按个数和保留时间删除历史版本，当前版本不会被删除
+func pruneVersions(name string, vers []*version) []*version {
+	cur := vers[len(vers)-1]
+	var keep []*version
+	for i, v := range vers[:len(vers)-1] {
+		old := len(vers) - 1 - i // 包括v在内比v新的历史版本个数
+		expired := VersionMaxAge > 0 && time.Since(v.time) > VersionMaxAge
+		if (VersionKeep > 0 && old > VersionKeep) || expired {
+			if err := removeFile(versionName(name, v.id)); err != nil {
+				log.Printf("删除历史版本失败, name:%s, id:%d, err:%s\n", name, v.id, err)
+				keep = append(keep, v)
+				continue
+			}
+			log.Printf("删除历史版本, name:%s, id:%d\n", name, v.id)
+			continue
+		}
+		keep = append(keep, v)
+	}
+	return append(keep, cur)
+}
+
+// listVersions 返回文件的所有版本，最后一个是当前版本
+func listVersions(name string) ([]*version, error) {
+	unlock, err := lockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return currentVersions(name)
+}
+
+// currentVersions 返回文件的所有版本，开启版本管理之前上传的文件为版本1，调用方需要锁定文件名
+func currentVersions(name string) ([]*version, error) {
+	vers, err := loadVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(vers) == 0 {
+		info, err := Store.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		vers = append(vers, &version{id: 1, time: info.ModTime, session: "-", size: info.Size})
+	}
+	return vers, nil
+}
+
+// restoreVersion 把历史版本恢复为当前版本，当前版本归档为历史版本
+func restoreVersion(name string, id int) error {
+	unlock, err := lockFile(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	vers, err := loadVersions(name)
+	if err != nil {
+		return err
+	}
+	idx := -1
+	for i, v := range vers {
+		if v.id == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("version %d not found", id)
+	}
+	if idx == len(vers)-1 {
+		// 已经是当前版本
+		return nil
+	}
+	cur := vers[len(vers)-1]
+	if err = moveFile(name, versionName(name, cur.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = moveFile(versionName(name, id), name); err != nil {
+		return err
+	}
+	// 恢复的版本移动到最后，成为当前版本
+	v := vers[idx]
+	vers = append(append(vers[:idx:idx], vers[idx+1:]...), v)
+	log.Printf("恢复历史版本, name:%s, id:%d\n", name, id)
+	return saveVersions(name, vers)
+}
+
+// openVersion 打开文件的指定版本，返回文件信息、端到端加密元数据和读取流
+// 锁定文件名后打开，读取的数据密钥和加密元数据与文件属于同一个版本，历史版本的元数据文件随版本归档
+func openVersion(name string, id int) (*snapshot, error) {
+	unlock, err := lockFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	vers, err := currentVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range vers {
+		if v.id != id {
+			continue
+		}
+		fn := versionName(name, id)
+		if i == len(vers)-1 {
+			fn = name
+		}
+		snap := &snapshot{}
+		if snap.info, err = Store.Stat(fn); err != nil {
+			return nil, err
+		}
+		if snap.meta, err = loadE2E(fn); err != nil {
+			return nil, fmt.Errorf("读取加密元数据失败: %s", err)
+		}
+		if snap.rc, err = openFile(fn); err != nil {
+			return nil, err
+		}
+		return snap, nil
+	}
+	return nil, fmt.Errorf("version %d not found", id)
+}
+
+// sendVersions 回复客户端文件的所有版本，每行一个版本，发送完成后关闭连接
+// 协议：id={id} time={unix} session={uid} size={size} current={true|false}
+func sendVersions(conn net.Conn, name string) {
+	vers, err := listVersions(name)
+	if err != nil {
+		log.Printf("查询文件版本失败, fn:%s, err:%s\n", name, err)
+		return
+	}
+	var b strings.Builder
+	for i, v := range vers {
+		fmt.Fprintf(&b, "%s current=%t\n", v, i == len(vers)-1)
+	}
+	writeBufferTimeOut(conn, []byte(b.String()))
+}
+
+// sendVersion 发送文件指定版本的内容，静态加密的文件解密后发送
+// 协议：先发送一行{file_size} [enc={meta} chunk={chunk_size} plain={size}]，失败时为fail，然后发送文件内容
+// 端到端加密的版本发送密文，携带这个版本的加密元数据、上传时拆分文件的明文大小和明文大小，客户端逐个解密
+func sendVersion(conn net.Conn, name string, id int) {
+	snap, err := openVersion(name, id)
+	if err != nil {
+		log.Printf("打开文件版本失败, fn:%s, id:%d, err:%s\n", name, id, err)
+		writeBufferTimeOut(conn, []byte("fail\n"))
+		return
+	}
+	defer snap.rc.Close()
+	head := strconv.FormatInt(snap.info.Size, 10)
+	if meta := snap.meta; meta != nil {
+		head += fmt.Sprintf(" enc=%s chunk=%d plain=%d", meta.enc, meta.chunk, meta.size)
+	}
+	if err = writeBufferTimeOut(conn, []byte(head+"\n")); err != nil {
+		return
+	}
+	if _, err = io.Copy(conn, snap.rc); err != nil {
+		log.Printf("发送文件版本失败, fn:%s, id:%d, err:%s\n", name, id, err)
+	}
+}
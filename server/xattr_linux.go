@@ -0,0 +1,10 @@
+//go:build linux
+
+package server
+
+import "syscall"
+
+// setxattr 设置文件的扩展属性
+func setxattr(fn, name string, value []byte) error {
+	return syscall.Setxattr(fn, name, value, 0)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// setxattr 非linux系统不支持扩展属性，忽略
+func setxattr(fn, name string, value []byte) error {
+	return nil
+}